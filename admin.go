@@ -0,0 +1,227 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+	"github.com/martini-contrib/render"
+
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AuditEvents lists the audit events, the most recent first.
+// URL: /admin/audit_events
+// Query parameters, all optional:
+// * instance_uuid - Only the events of the instance
+// * org_guid - Only the events of the instances of the organization
+// * since - Only the events from that time on (RFC 3339)
+// * until - Only the events before that time (RFC 3339)
+func AuditEvents(req *http.Request, r render.Render, brokerDb *gorm.DB) {
+	query := req.URL.Query()
+	db := brokerDb
+
+	if instanceUuid := query.Get("instance_uuid"); instanceUuid != "" {
+		db = db.Where("instance_uuid = ?", instanceUuid)
+	}
+	if orgGuid := query.Get("org_guid"); orgGuid != "" {
+		db = db.Where("org_guid = ?", orgGuid)
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			r.JSON(http.StatusBadRequest, Response{"since must be a RFC 3339 time"})
+			return
+		}
+		db = db.Where("created_at >= ?", t)
+	}
+	if until := query.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			r.JSON(http.StatusBadRequest, Response{"until must be a RFC 3339 time"})
+			return
+		}
+		db = db.Where("created_at < ?", t)
+	}
+
+	events := []AuditEvent{}
+	db.Order("created_at desc, id desc").Find(&events)
+	r.JSON(http.StatusOK, map[string]interface{}{
+		"events": events,
+	})
+}
+
+// SharedServerReq is the body of the requests registering and changing a shared server.
+type SharedServerReq struct {
+	Name     string  `json:"name"`
+	DbType   string  `json:"db_type"`
+	Url      string  `json:"url"`
+	Port     int64   `json:"port"`
+	DbName   string  `json:"db_name"`
+	Username string  `json:"username"`
+	Password string  `json:"password"`
+	Sslmode  string  `json:"sslmode"`
+	Tags     *string `json:"tags"`
+	Enabled  *bool   `json:"enabled"`
+}
+
+// SharedServers lists the shared servers.
+// URL: /admin/shared_servers
+func SharedServers(r render.Render, brokerDb *gorm.DB) {
+	servers := []SharedServer{}
+	brokerDb.Order("id").Find(&servers)
+	r.JSON(http.StatusOK, map[string]interface{}{
+		"servers": servers,
+	})
+}
+
+// CreateSharedServer registers a shared server, new shared instances can be placed on it right away
+// unless enabled is false. The port defaults to the port of db_type.
+// URL: /admin/shared_servers
+// Request:
+// {
+//   "name":     "Unique name of the server",
+//   "db_type":  "postgres or mysql",
+//   "url":      "Hostname of the server",
+//   "port":     5432,
+//   "db_name":  "Database to connect to",
+//   "username": "User able to create databases and users",
+//   "password": "Password of the user",
+//   "sslmode":  "SSL mode to connect with, defaults to require",
+//   "tags":     "Comma separated tags",
+//   "enabled":  true
+// }
+func CreateSharedServer(req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings) {
+	sr := SharedServerReq{}
+	if err := json.NewDecoder(req.Body).Decode(&sr); err != nil {
+		r.JSON(http.StatusBadRequest, Response{"Invalid request"})
+		return
+	}
+	if sr.Name == "" || sr.Url == "" || sr.Username == "" || sr.Password == "" {
+		r.JSON(http.StatusBadRequest, Response{"name, url, username and password are required"})
+		return
+	}
+	if sr.DbType != "postgres" && sr.DbType != "mysql" {
+		r.JSON(http.StatusBadRequest, Response{"db_type must be postgres or mysql"})
+		return
+	}
+
+	existing := SharedServer{}
+	brokerDb.Where("name = ?", sr.Name).First(&existing)
+	if existing.Id != 0 {
+		r.JSON(http.StatusConflict, Response{"The server already exists"})
+		return
+	}
+
+	server := SharedServer{
+		Name:     sr.Name,
+		DbType:   sr.DbType,
+		Url:      sr.Url,
+		Port:     sr.Port,
+		DbName:   sr.DbName,
+		Username: sr.Username,
+		Sslmode:  sr.Sslmode,
+		Enabled:  true,
+	}
+	if server.Port == 0 {
+		server.Port = DefaultPort(server.DbType)
+	}
+	if server.Sslmode == "" {
+		server.Sslmode = "require"
+	}
+	if sr.Tags != nil {
+		server.Tags = *sr.Tags
+	}
+	if sr.Enabled != nil {
+		server.Enabled = *sr.Enabled
+	}
+	if err := server.SetPassword(sr.Password, s.EncryptionKey); err != nil {
+		r.JSON(http.StatusInternalServerError, Response{"There was an error registering the server. Error: " + err.Error()})
+		return
+	}
+
+	if err := brokerDb.Create(&server).Error; err != nil {
+		r.JSON(http.StatusInternalServerError, Response{"There was an error registering the server. Error: " + err.Error()})
+		return
+	}
+	r.JSON(http.StatusCreated, server)
+}
+
+// UpdateSharedServer changes the password, the tags or the enabled flag of a shared server.
+// The other attributes can't change once instances are hosted on the server.
+// URL: /admin/shared_servers/:id
+// Request, all optional:
+// {
+//   "password": "New password of the user",
+//   "tags":     "Comma separated tags",
+//   "enabled":  false
+// }
+func UpdateSharedServer(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings) {
+	server := SharedServer{}
+	brokerDb.Where("id = ?", p["id"]).First(&server)
+	if server.Id == 0 {
+		r.JSON(http.StatusNotFound, Response{"Server not found"})
+		return
+	}
+
+	sr := SharedServerReq{}
+	if err := json.NewDecoder(req.Body).Decode(&sr); err != nil {
+		r.JSON(http.StatusBadRequest, Response{"Invalid request"})
+		return
+	}
+	if sr.Name != "" || sr.DbType != "" || sr.Url != "" || sr.Port != 0 || sr.DbName != "" || sr.Username != "" || sr.Sslmode != "" {
+		r.JSON(http.StatusBadRequest, Response{"Only password, tags and enabled can be changed"})
+		return
+	}
+
+	if sr.Password != "" {
+		if err := server.SetPassword(sr.Password, s.EncryptionKey); err != nil {
+			r.JSON(http.StatusInternalServerError, Response{"There was an error updating the server. Error: " + err.Error()})
+			return
+		}
+	}
+	if sr.Tags != nil {
+		server.Tags = *sr.Tags
+	}
+	if sr.Enabled != nil {
+		server.Enabled = *sr.Enabled
+	}
+
+	if err := brokerDb.Save(&server).Error; err != nil {
+		r.JSON(http.StatusInternalServerError, Response{"There was an error updating the server. Error: " + err.Error()})
+		return
+	}
+	// The open connection to the server logged in with the previous password.
+	if sr.Password != "" {
+		dbConfig, err := server.DBConfig(s.EncryptionKey)
+		if err == nil {
+			err = CloseSharedDBConn(dbConfig)
+		}
+		if err != nil {
+			log.Println("Unable to close the connection to the shared server " + server.Name + ": " + err.Error())
+		}
+	}
+	r.JSON(http.StatusOK, server)
+}
+
+// DeleteSharedServer unregisters a shared server. Servers still hosting instances can't be unregistered.
+// URL: /admin/shared_servers/:id
+func DeleteSharedServer(p martini.Params, r render.Render, brokerDb *gorm.DB) {
+	server := SharedServer{}
+	brokerDb.Where("id = ?", p["id"]).First(&server)
+	if server.Id == 0 {
+		r.JSON(http.StatusNotFound, Response{"Server not found"})
+		return
+	}
+
+	var count int64
+	brokerDb.Model(Instance{}).Where("shared_server_id = ?", server.Id).Count(&count)
+	if count > 0 {
+		r.JSON(http.StatusConflict, Response{"The server still hosts instances"})
+		return
+	}
+
+	brokerDb.Delete(&server)
+	r.JSON(http.StatusOK, Response{"The server was unregistered"})
+}
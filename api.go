@@ -7,7 +7,9 @@ import (
 
 	"encoding/json"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
 )
 
 type Response struct {
@@ -22,7 +24,7 @@ type ErrorResponse struct {
 type Operation struct {
 	State                    string
 	Description              string
-	AsyncPollIntervalSeconds int `json:"async_poll_interval_seconds, omitempty"`
+	AsyncPollIntervalSeconds int `json:"async_poll_interval_seconds,omitempty"`
 }
 
 type CreateResponse struct {
@@ -31,10 +33,32 @@ type CreateResponse struct {
 }
 
 type ServiceReq struct {
-	ServiceId        string `json:"service_id"`
-	PlanId           string `json:"plan_id"`
-	OrganizationGuid string `json:"organization_guid"`
-	SpaceGuid        string `json:"space_guid"`
+	ServiceId        string          `json:"service_id"`
+	PlanId           string          `json:"plan_id"`
+	OrganizationGuid string          `json:"organization_guid"`
+	SpaceGuid        string          `json:"space_guid"`
+	Parameters       json.RawMessage `json:"parameters"`
+}
+
+type UpdateReq struct {
+	ServiceId  string          `json:"service_id"`
+	PlanId     string          `json:"plan_id"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+type InstanceResponse struct {
+	ServiceId    string          `json:"service_id"`
+	PlanId       string          `json:"plan_id"`
+	DashboardUrl string          `json:"dashboard_url,omitempty"`
+	Parameters   json.RawMessage `json:"parameters"`
+	// Usage is the storage usage of the shared instances.
+	Usage *InstanceUsage `json:"usage,omitempty"`
+}
+
+type BindReq struct {
+	ServiceId string `json:"service_id"`
+	PlanId    string `json:"plan_id"`
+	AppGuid   string `json:"app_guid"`
 }
 
 // CreateInstance
@@ -44,9 +68,12 @@ type ServiceReq struct {
 //   "service_id":        "service-guid-here",
 //   "plan_id":           "plan-guid-here",
 //   "organization_guid": "org-guid-here",
-//   "space_guid":        "space-guid-here"
+//   "space_guid":        "space-guid-here",
+//   "parameters":        {
+//     "storage_gb": 50
+//   }
 // }
-func CreateInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog) {
+func CreateInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog, identity OriginatingIdentity) {
 	instance := Instance{}
 
 	brokerDb.Where("uuid = ?", p["id"]).First(&instance)
@@ -72,8 +99,10 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, broker
 		return
 	}
 
-	// Get the correct database logic depending on the type of plan. (shared vs dedicated)
-	adapter, _ := s.InitializeAdapter(plan, brokerDb)
+	if err := plan.validateCreateParameters(sr.Parameters); err != nil {
+		r.JSON(http.StatusBadRequest, Response{"Invalid parameters: " + err.Error()})
+		return
+	}
 
 	shared := plan.Adapter == AdapterShared
 
@@ -102,6 +131,44 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, broker
 		return
 	}
 
+	if err := instance.ApplyParameters(sr.Parameters); err != nil {
+		r.JSON(http.StatusBadRequest, Response{"Invalid parameters: " + err.Error()})
+		return
+	}
+
+	// Resolve the instance to restore or to clone the new instance from.
+	if instance.SourceInstanceId != "" {
+		source, err := sourceInstance(brokerDb, &instance)
+		if err != nil {
+			r.JSON(http.StatusBadRequest, Response{err.Error()})
+			return
+		}
+		instance.SourceDatabase = source.Database
+		// The shared clones are copied on the server of their source.
+		instance.SharedServerId = source.SharedServerId
+	}
+
+	// Pick the server of the shared instance.
+	if shared && instance.SourceInstanceId == "" {
+		server, err := PlaceSharedInstance(brokerDb, plan, s.SharedPlacement)
+		if err != nil {
+			desc := "There was an error placing the instance. Error: " + err.Error()
+			r.JSON(http.StatusInternalServerError, Response{desc})
+			return
+		}
+		if server != nil {
+			instance.SharedServerId = server.Id
+		}
+	}
+
+	// Get the correct database logic depending on the type of plan. (shared vs dedicated)
+	adapter, err := s.InitializeAdapter(plan, &instance, brokerDb)
+	if err != nil {
+		desc := "There was an error creating the instance. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+
 	// Create the database instance.
 	status, err := adapter.CreateDB(&instance, instance.ClearPassword)
 	if status == InstanceNotCreated {
@@ -109,22 +176,18 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, broker
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
 		}
-		r.JSON(http.StatusInternalServerError, Response{desc})
+		code := http.StatusInternalServerError
+		if isRestoreRequestError(err) {
+			code = http.StatusBadRequest
+		}
+		r.JSON(code, Response{desc})
 		return
 	}
 
 	instance.State = status
 
-	// FIXME
-	// Currently, if we are dealing with a shared database, it will not populate the host and port fields of the instance.
-	// Also, currently, the shared database instance just create a new database and user inside the intenral broker database.
-	// Eventually we want to register a DBConfig or a pool of database connections for the shared instances to get the host and port
-	// and move the logic of storing it in the instance in the SharedDB's CreateDB.
-	if instance.Adapter == "shared" {
-		instance.Host = s.DbConfig.Url
-		instance.Port = s.DbConfig.Port
-	}
 	brokerDb.Save(&instance)
+	audit(brokerDb, AuditCreate, &instance, "", identity)
 
 	if shared {
 		r.JSON(http.StatusCreated, Response{"The instance was created"})
@@ -133,30 +196,353 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, broker
 	}
 }
 
+// sourceInstance returns the instance to restore or to clone the instance from. It has to be an instance
+// of the same adapter and database engine in the organization of the instance.
+func sourceInstance(brokerDb *gorm.DB, i *Instance) (*Instance, error) {
+	source := Instance{}
+	brokerDb.Where("uuid = ?", i.SourceInstanceId).First(&source)
+	if source.Id == 0 || source.OrgGuid != i.OrgGuid || source.Adapter != i.Adapter || source.DbType != i.DbType {
+		return nil, ErrSourceInstanceNotAllowed
+	}
+	return &source, nil
+}
+
+// isRestoreRequestError tells if the creation of a restored instance failed because of its parameters.
+func isRestoreRequestError(err error) bool {
+	if _, ok := err.(*RestoreWindowError); ok {
+		return true
+	}
+	return err == ErrSnapshotNotAllowed || err == ErrSourceInstanceNotAllowed || err == ErrCloneNotSupported ||
+		err == ErrAuroraRestoreNotSupported
+}
+
+// endpointChanged tells if binding or unbinding the instance changed its state or loaded its endpoint.
+func endpointChanged(before, after *Instance) bool {
+	return before.State != after.State || before.Host != after.Host || before.Port != after.Port ||
+		before.ReaderHost != after.ReaderHost
+}
+
+// UpdateInstance
+// URL: /v2/service_instances/:id
+// Request:
+// {
+//   "service_id":      "service-guid-here",
+//   "plan_id":         "plan-guid-here",
+//   "previous_values": {
+//     "plan_id": "old-plan-guid-here"
+//   }
+// }
+func UpdateInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog, identity OriginatingIdentity) {
+	instance := Instance{}
+
+	brokerDb.Where("uuid = ?", p["id"]).First(&instance)
+
+	if instance.Id == 0 {
+		r.JSON(http.StatusNotFound, Response{"Instance not found"})
+		return
+	}
+
+	if instance.OperationInProgress() {
+		concurrencyError(r)
+		return
+	}
+
+	var ur UpdateReq
+
+	if req.Body == nil {
+		r.JSON(http.StatusBadRequest, Response{"No request"})
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	json.Unmarshal(body, &ur)
+
+	planId := ur.PlanId
+	if planId == "" {
+		planId = instance.PlanId
+	}
+	changingPlan := planId != instance.PlanId
+
+	currentPlan := catalog.fetchPlan(instance.ServiceId, instance.PlanId)
+	plan := catalog.fetchPlan(instance.ServiceId, planId)
+	if currentPlan == nil || plan == nil {
+		r.JSON(http.StatusBadRequest, Response{"The plan requested does not exist"})
+		return
+	}
+
+	if err := plan.validateUpdateParameters(ur.Parameters); err != nil {
+		r.JSON(http.StatusBadRequest, Response{"Invalid parameters: " + err.Error()})
+		return
+	}
+	changingParameters, err := instance.ApplyUpdateParameters(ur.Parameters)
+	if err != nil {
+		r.JSON(http.StatusBadRequest, Response{"Invalid parameters: " + err.Error()})
+		return
+	}
+
+	// Nothing to do if neither the plan nor the parameters are changing.
+	if !changingPlan && !changingParameters {
+		var emptyJson struct{}
+		r.JSON(http.StatusOK, emptyJson)
+		return
+	}
+
+	// Plans can only be changed between plans that use the same adapter.
+	if changingPlan && (!currentPlan.PlanUpdateable || !plan.PlanUpdateable || currentPlan.Adapter != plan.Adapter) {
+		// UNPROCESSABLE_ENTITY
+		r.JSON(422, ErrorResponse{Error: "PlanChangeNotSupported", Description: "The service plan cannot be changed to the plan requested."})
+		return
+	}
+
+	shared := plan.Adapter == AdapterShared
+
+	acceptsIncomplete := false
+	if req.URL.Query().Get("accepts_incomplete") == "true" {
+		acceptsIncomplete = true
+	}
+
+	if !shared && !acceptsIncomplete {
+		// UNPROCESSABLE_ENTITY
+		r.JSON(422, ErrorResponse{Error: "AsyncRequired", Description: "This service plan requires client support for asynchronous service operations."})
+		return
+	}
+
+	// Get the correct database logic depending on the type of plan. (shared vs dedicated)
+	adapter, err := s.InitializeAdapter(plan, &instance, brokerDb)
+	if err != nil {
+		desc := "There was an error updating the instance. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+
+	// The engine parameters are set in the parameter group of the instance, which the update attaches.
+	if parameterGroupAdapter, ok := adapter.(ParameterGroupAdapter); ok && changingParameters {
+		if err := parameterGroupAdapter.ApplyEngineParameters(&instance); err != nil {
+			desc := "There was an error setting the engine parameters. Error: " + err.Error()
+			r.JSON(http.StatusInternalServerError, Response{desc})
+			return
+		}
+	}
+
+	// Update the database instance.
+	if changingPlan {
+		instance.ChangePlan(plan)
+	}
+	status, err := adapter.UpdateDB(&instance)
+	if status == InstanceNotUpdated {
+		desc := "There was an error updating the instance."
+		if err != nil {
+			desc = desc + " Error: " + err.Error()
+		}
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+
+	instance.State = status
+	brokerDb.Save(&instance)
+	audit(brokerDb, AuditUpdate, &instance, "", identity)
+
+	if shared {
+		r.JSON(http.StatusOK, Response{"The instance was updated"})
+	} else {
+		r.JSON(http.StatusAccepted, Response{"The instance is being updated asynchronously"})
+	}
+}
+
+// FetchInstance
+// URL: /v2/service_instances/:id
+func FetchInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, version BrokerAPIVersion) {
+	if !version.AtLeast(2, 14) {
+		r.JSON(http.StatusPreconditionFailed, Response{"Fetching an instance requires broker API version 2.14"})
+		return
+	}
+
+	instance := Instance{}
+
+	brokerDb.Where("uuid = ?", p["id"]).First(&instance)
+
+	if instance.Id == 0 {
+		r.JSON(http.StatusNotFound, Response{"Instance not found"})
+		return
+	}
+
+	parameters := json.RawMessage("{}")
+	if instance.Parameters != "" {
+		parameters = json.RawMessage(instance.Parameters)
+	}
+
+	r.JSON(http.StatusOK, InstanceResponse{
+		ServiceId:  instance.ServiceId,
+		PlanId:     instance.PlanId,
+		Parameters: parameters,
+		Usage:      instance.Usage(),
+	})
+}
+
 func LastOperationInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog) {
 	instance := Instance{}
 
 	brokerDb.Where("uuid = ?", p["id"]).First(&instance)
 
 	if instance.Id <= 0 {
+		// Instances deleted asynchronously are gone, any other id was never there.
+		brokerDb.Unscoped().Where("uuid = ?", p["id"]).First(&instance)
+		if instance.Id > 0 {
+			var emptyJson struct{}
+			r.JSON(http.StatusGone, emptyJson)
+			return
+		}
 		r.JSON(http.StatusNotFound, Response{"Requested instance id cannot be found"})
 		return
 	}
 	plan := catalog.fetchPlan(instance.ServiceId, instance.PlanId)
-	adapter, _ := s.InitializeAdapter(plan, brokerDb)
-	status, _ := adapter.GetDBStatus(&instance)
+	adapter, err := s.InitializeAdapter(plan, &instance, brokerDb)
+	if err != nil {
+		desc := "There was an error checking the instance. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+	// The dedicated clones are restored once the snapshot of their source is taken.
+	if instance.SnapshotPending {
+		if cloneAdapter, ok := adapter.(CloneAdapter); ok {
+			if lock := AcquireInstanceLock(brokerDb, instance.Uuid, "last_operation"); lock != nil {
+				defer ReleaseInstanceLock(brokerDb, lock)
+				// The settings of the broker the instance got in Init are not stored.
+				instance.Tags = s.InstanceTags
+				instance.DbSubnetGroup = s.SubnetGroup
+				if _, err := cloneAdapter.RestoreClone(&instance); err != nil {
+					// The creation is over, the platform deletes the instance.
+					instance.SnapshotPending = false
+					instance.State = InstanceReady
+					brokerDb.Save(&instance)
+					r.JSON(http.StatusOK, InstanceStatus{State: InstanceCreationFailed, Description: "The clone could not be restored. Error: " + err.Error()})
+					return
+				}
+				brokerDb.Save(&instance)
+			}
+		}
+		r.JSON(http.StatusOK, InstanceStatus{State: InstanceCreationInProgress, Description: "Copying the source instance"})
+		return
+	}
+
+	status, err := adapter.GetDBStatus(&instance)
+
+	// The instances restored from a snapshot get the password and the settings of the broker once available.
+	if instance.RestorePending && err == nil && status.State == InstanceCreationSucceeded {
+		status = InstanceStatus{State: InstanceCreationInProgress, Description: "Applying the settings of the broker to the restored instance"}
+		if restoreAdapter, ok := adapter.(RestoreAdapter); ok {
+			if lock := AcquireInstanceLock(brokerDb, instance.Uuid, "last_operation"); lock != nil {
+				password, restoreErr := instance.GetPassword(s.EncryptionKey)
+				if restoreErr == nil {
+					restoreErr = restoreAdapter.FinishRestore(&instance, password)
+				}
+				// Without the settings of the broker the instance can't be bound, its creation failed.
+				if restoreErr != nil {
+					log.Println("Unable to finish the restore of the instance " + instance.Uuid + ": " + restoreErr.Error())
+					status = InstanceStatus{State: InstanceCreationFailed, Description: "The settings of the broker could not be applied to the restored instance. Error: " + restoreErr.Error()}
+					instance.SetupPending = false
+				}
+				instance.RestorePending = false
+				brokerDb.Save(&instance)
+				ReleaseInstanceLock(brokerDb, lock)
+			}
+		}
+	}
+
+	// The database of the dedicated instances is prepared for the bindings once it is available and restored.
+	if instance.SetupPending && !instance.RestorePending && err == nil && status.State == InstanceCreationSucceeded {
+		available := status
+		status = InstanceStatus{State: InstanceCreationInProgress, Description: "Preparing the database of the instance"}
+		if setupAdapter, ok := adapter.(SetupAdapter); ok {
+			if lock := AcquireInstanceLock(brokerDb, instance.Uuid, "last_operation"); lock != nil {
+				password, setupErr := instance.GetPassword(s.EncryptionKey)
+				if setupErr == nil {
+					setupErr = setupAdapter.SetupDB(&instance, password)
+				}
+				status = available
+				if setupErr != nil {
+					log.Println("Unable to prepare the database of the instance " + instance.Uuid + ": " + setupErr.Error())
+					status = InstanceStatus{State: InstanceCreationFailed, Description: "The database of the instance could not be prepared. Error: " + setupErr.Error()}
+				}
+				instance.SetupPending = false
+				brokerDb.Save(&instance)
+				ReleaseInstanceLock(brokerDb, lock)
+			}
+		}
+	}
+
+	// The read replicas are created once the instance is available, the operation goes on until they are available too.
+	if err == nil && status.State == InstanceCreationSucceeded && instance.State != InstanceDeleting {
+		if replicaAdapter, ok := adapter.(ReplicaAdapter); ok {
+			lock := AcquireInstanceLock(brokerDb, instance.Uuid, "last_operation")
+			if lock == nil {
+				r.JSON(http.StatusOK, InstanceStatus{State: InstanceCreationInProgress, Description: "The read replicas are being changed"})
+				return
+			}
+			pending, replicaErr := replicaAdapter.SyncReplicas(&instance)
+			brokerDb.Save(&instance)
+			ReleaseInstanceLock(brokerDb, lock)
+			switch {
+			case replicaErr != nil:
+				status = InstanceStatus{State: InstanceCreationFailed, Description: "The read replicas could not be created. Error: " + replicaErr.Error()}
+			case pending:
+				status = InstanceStatus{State: InstanceCreationInProgress, Description: "Creating the read replicas"}
+			}
+		}
+	}
+
+	if instance.State == InstanceDeleting {
+		// Finishing the deletion changes the instance, wait for the other operation changing it.
+		lock := AcquireInstanceLock(brokerDb, instance.Uuid, "last_operation")
+		if lock == nil {
+			r.JSON(http.StatusOK, InstanceStatus{State: InstanceCreationInProgress, Description: "The instance is being deleted"})
+			return
+		}
+		defer ReleaseInstanceLock(brokerDb, lock)
+		switch {
+		case err == ErrInstanceNotFound:
+			// The database is gone, so is the instance.
+			if snapshotAdapter, ok := adapter.(FinalSnapshotAdapter); ok && instance.FinalSnapshotId != "" {
+				if err := snapshotAdapter.TagFinalSnapshot(&instance); err != nil {
+					log.Println("Unable to tag the final snapshot " + instance.FinalSnapshotId + ": " + err.Error())
+				}
+			}
+			if parameterGroupAdapter, ok := adapter.(ParameterGroupAdapter); ok {
+				if err := parameterGroupAdapter.DeleteParameterGroup(&instance); err != nil {
+					log.Println("Unable to delete the parameter group " + instance.ParameterGroup + ": " + err.Error())
+				}
+			}
+			brokerDb.Delete(&instance)
+			var emptyJson struct{}
+			r.JSON(http.StatusGone, emptyJson)
+			return
+		case status.State == InstanceCreationSucceeded || status.State == InstanceCreationFailed:
+			// The database is not being deleted anymore. Let the deletion be retried.
+			instance.State = InstanceReady
+			brokerDb.Save(&instance)
+			status.State = InstanceCreationFailed
+			status.Description = "The instance could not be deleted. " + status.Description
+		}
+	}
+
+	// The creation or the update is over, the instance can be changed again.
+	if instance.State == InstanceInProgress && !instance.OperationPending() &&
+		(status.State == InstanceCreationSucceeded || status.State == InstanceCreationFailed) {
+		instance.State = InstanceReady
+		brokerDb.Save(&instance)
+	}
 	r.JSON(http.StatusOK, status)
 }
 
 // BindInstance
-// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id
+// URL: /v2/service_instances/:instance_id/service_bindings/:id
 // Request:
 // {
 //   "plan_id":        "plan-guid-here",
 //   "service_id":     "service-guid-here",
 //   "app_guid":       "app-guid-here"
 // }
-func BindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog) {
+func BindInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog, identity OriginatingIdentity) {
 	instance := Instance{}
 
 	brokerDb.Where("uuid = ?", p["instance_id"]).First(&instance)
@@ -164,9 +550,44 @@ func BindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Setti
 		r.JSON(http.StatusNotFound, Response{"Instance not found"})
 		return
 	}
+
+	if instance.OperationInProgress() {
+		concurrencyError(r)
+		return
+	}
+
+	var br BindReq
+
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &br)
+	}
+
+	// Binding the same id again returns the existing credentials
+	// unless it was requested with different attributes.
+	binding := Binding{}
+	brokerDb.Where("uuid = ?", p["id"]).First(&binding)
+	if binding.Id > 0 {
+		if binding.InstanceUuid != instance.Uuid || binding.AppGuid != br.AppGuid {
+			r.JSON(http.StatusConflict, Response{"The binding already exists with different attributes"})
+			return
+		}
+		credentials, err := binding.GetCredentials(&instance, s.EncryptionKey)
+		if err != nil {
+			desc := "There was an error getting the credentials of the binding. Error: " + err.Error()
+			r.JSON(http.StatusInternalServerError, Response{desc})
+			return
+		}
+		r.JSON(http.StatusOK, map[string]interface{}{
+			"credentials": credentials,
+		})
+		return
+	}
+
 	password, err := instance.GetPassword(s.EncryptionKey)
 	if err != nil {
-		r.JSON(http.StatusInternalServerError, "Unable to get instance password.")
+		r.JSON(http.StatusInternalServerError, Response{"Unable to get instance password."})
+		return
 	}
 
 	plan := catalog.fetchPlan(instance.ServiceId, instance.PlanId)
@@ -177,17 +598,23 @@ func BindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Setti
 	}
 
 	// Get the correct database logic depending on the type of plan. (shared vs dedicated)
-	db, err := s.InitializeAdapter(plan, brokerDb)
+	db, err := s.InitializeAdapter(plan, &instance, brokerDb)
 	if err != nil {
 		desc := "There was an error creating the instance. Error: " + err.Error()
 		r.JSON(http.StatusInternalServerError, Response{desc})
 		return
 	}
 
-	var credentials map[string]string
+	if err = binding.Init(p["id"], br.AppGuid, &instance, s); err != nil {
+		desc := "There was an error initializing the binding. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+
+	var credentials map[string]interface{}
 	// Bind the database instance to the application.
-	originalInstanceState := instance.State
-	if credentials, err = db.BindDBToApp(&instance, password); err != nil {
+	originalInstance := instance
+	if credentials, err = db.BindDBToApp(&instance, password, &binding); err != nil {
 		desc := "There was an error binding the database instance to the application."
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
@@ -196,10 +623,12 @@ func BindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Setti
 		return
 	}
 
-	// If the state of the instance has changed, update it.
-	if instance.State != originalInstanceState {
+	// If the state or the endpoint of the instance has changed, update it.
+	if endpointChanged(&originalInstance, &instance) {
 		brokerDb.Save(&instance)
 	}
+	brokerDb.Save(&binding)
+	audit(brokerDb, AuditBind, &instance, binding.Uuid, identity)
 
 	response := map[string]interface{}{
 		"credentials": credentials,
@@ -207,6 +636,99 @@ func BindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Setti
 	r.JSON(http.StatusCreated, response)
 }
 
+// FetchBinding
+// URL: /v2/service_instances/:instance_id/service_bindings/:id
+func FetchBinding(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Settings, version BrokerAPIVersion) {
+	if !version.AtLeast(2, 14) {
+		r.JSON(http.StatusPreconditionFailed, Response{"Fetching a binding requires broker API version 2.14"})
+		return
+	}
+
+	instance := Instance{}
+	binding := Binding{}
+
+	brokerDb.Where("uuid = ?", p["instance_id"]).First(&instance)
+	if instance.Id > 0 {
+		brokerDb.Where("uuid = ? AND instance_uuid = ?", p["id"], instance.Uuid).First(&binding)
+	}
+	if binding.Id == 0 {
+		r.JSON(http.StatusNotFound, Response{"Binding not found"})
+		return
+	}
+
+	credentials, err := binding.GetCredentials(&instance, s.EncryptionKey)
+	if err != nil {
+		desc := "There was an error getting the credentials of the binding. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+
+	r.JSON(http.StatusOK, map[string]interface{}{
+		"credentials": credentials,
+	})
+}
+
+// UnbindInstance
+// URL: /v2/service_instances/:instance_id/service_bindings/:id
+// Request:
+// {
+//   "service_id": "service-id-here"
+//   "plan_id":    "plan-id-here"
+// }
+func UnbindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog, identity OriginatingIdentity) {
+	var emptyJson struct{}
+	instance := Instance{}
+	binding := Binding{}
+
+	brokerDb.Where("uuid = ?", p["instance_id"]).First(&instance)
+	if instance.Id > 0 {
+		brokerDb.Where("uuid = ? AND instance_uuid = ?", p["id"], instance.Uuid).First(&binding)
+	}
+	if binding.Id == 0 {
+		r.JSON(http.StatusGone, emptyJson)
+		return
+	}
+
+	if instance.OperationInProgress() {
+		concurrencyError(r)
+		return
+	}
+	password, err := instance.GetPassword(s.EncryptionKey)
+	if err != nil {
+		r.JSON(http.StatusInternalServerError, Response{"Unable to get instance password."})
+		return
+	}
+
+	plan := catalog.fetchPlan(instance.ServiceId, instance.PlanId)
+
+	if plan == nil {
+		r.JSON(http.StatusBadRequest, Response{"The plan requested does not exist"})
+		return
+	}
+
+	// Get the correct database logic depending on the type of plan. (shared vs dedicated)
+	db, err := s.InitializeAdapter(plan, &instance, brokerDb)
+	if err != nil {
+		desc := "There was an error unbinding the instance. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+
+	// Revoke the credentials of the binding.
+	originalInstance := instance
+	if err = db.UnbindDBFromApp(&instance, password, &binding); err != nil {
+		desc := "There was an error unbinding the database instance from the application. Error: " + err.Error()
+		r.JSON(http.StatusInternalServerError, Response{desc})
+		return
+	}
+	if endpointChanged(&originalInstance, &instance) {
+		brokerDb.Save(&instance)
+	}
+	brokerDb.Delete(&binding)
+	audit(brokerDb, AuditUnbind, &instance, binding.Uuid, identity)
+	r.JSON(http.StatusOK, emptyJson)
+}
+
 // DeleteInstance
 // URL: /v2/service_instances/:id
 // Request:
@@ -214,7 +736,7 @@ func BindInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Setti
 //   "service_id": "service-id-here"
 //   "plan_id":    "plan-id-here"
 // }
-func DeleteInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog) {
+func DeleteInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *Settings, catalog *Catalog, identity OriginatingIdentity) {
 	instance := Instance{}
 
 	brokerDb.Where("uuid = ?", p["id"]).First(&instance)
@@ -231,8 +753,49 @@ func DeleteInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Set
 		r.JSON(http.StatusBadRequest, Response{"The plan requested does not exist"})
 		return
 	}
+
+	shared := plan.Adapter == AdapterShared
+
+	acceptsIncomplete := false
+	if req.URL.Query().Get("accepts_incomplete") == "true" {
+		acceptsIncomplete = true
+	}
+
+	if !shared && !acceptsIncomplete {
+		// UNPROCESSABLE_ENTITY
+		r.JSON(422, ErrorResponse{Error: "AsyncRequired", Description: "This service plan requires client support for asynchronous service operations."})
+		return
+	}
+
+	// The deletion was already started, it is tracked by last_operation.
+	if instance.State == InstanceDeleting {
+		r.JSON(http.StatusAccepted, Response{"The instance is being deleted asynchronously"})
+		return
+	}
+	if instance.OperationInProgress() {
+		concurrencyError(r)
+		return
+	}
+
+	// Keep the data of the dedicated instances in a final snapshot, unless told otherwise.
+	instance.FinalSnapshotId = ""
+	if !shared {
+		finalSnapshot := plan.FinalSnapshot
+		if value := req.URL.Query().Get("final_snapshot"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				r.JSON(http.StatusBadRequest, Response{"final_snapshot must be true or false"})
+				return
+			}
+			finalSnapshot = parsed
+		}
+		if finalSnapshot {
+			instance.FinalSnapshotId = instance.FinalSnapshotName()
+		}
+	}
+
 	// Get the correct database logic depending on the type of plan. (shared vs dedicated)
-	db, err := s.InitializeAdapter(plan, brokerDb)
+	db, err := s.InitializeAdapter(plan, &instance, brokerDb)
 	if err != nil {
 		desc := "There was an error deleting the instance. Error: " + err.Error()
 		r.JSON(http.StatusInternalServerError, Response{desc})
@@ -248,6 +811,23 @@ func DeleteInstance(p martini.Params, r render.Render, brokerDb *gorm.DB, s *Set
 		r.JSON(http.StatusInternalServerError, Response{desc})
 		return
 	}
+
+	// Keep the instance around until the database is gone.
+	if status == InstanceInProgress {
+		instance.State = InstanceDeleting
+		brokerDb.Save(&instance)
+		audit(brokerDb, AuditDelete, &instance, "", identity)
+		r.JSON(http.StatusAccepted, Response{"The instance is being deleted asynchronously"})
+		return
+	}
 	brokerDb.Delete(&instance)
+	audit(brokerDb, AuditDelete, &instance, "", identity)
 	r.JSON(http.StatusOK, Response{"The instance was deleted"})
 }
+
+// audit records who performed an action on an instance.
+func audit(brokerDb *gorm.DB, action string, instance *Instance, bindingUuid string, identity OriginatingIdentity) {
+	event := AuditEvent{}
+	event.Init(action, instance, bindingUuid, identity)
+	brokerDb.Save(&event)
+}
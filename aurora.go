@@ -0,0 +1,502 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/rds"
+
+	"errors"
+	"fmt"
+	"log"
+)
+
+// auroraEngines are the RDS engines of the Aurora clusters, by database type.
+var auroraEngines = map[string]string{
+	"postgres": "aurora-postgresql",
+	"mysql":    "aurora-mysql",
+}
+
+// auroraMaxInstances is the maximum number of instances of a cluster, the writer and 15 readers.
+const auroraMaxInstances = 16
+
+// ErrAuroraRestoreNotSupported is returned when an Aurora instance is asked to be restored or cloned.
+var ErrAuroraRestoreNotSupported = errors.New("The Aurora instances cannot be restored or cloned")
+
+// The cluster actions are newer than the vendored SDK. Their inputs and outputs follow the shapes of the SDK,
+// so that its query protocol serializes them, and they are sent with rdsRequest.
+
+type createDBClusterInput struct {
+	BackupRetentionPeriod      *int64     `type:"integer"`
+	DBClusterIdentifier        *string    `type:"string" required:"true"`
+	DBSubnetGroupName          *string    `type:"string"`
+	DatabaseName               *string    `type:"string"`
+	Engine                     *string    `type:"string" required:"true"`
+	EngineVersion              *string    `type:"string"`
+	MasterUserPassword         *string    `type:"string"`
+	MasterUsername             *string    `type:"string"`
+	Port                       *int64     `type:"integer"`
+	PreferredBackupWindow      *string    `type:"string"`
+	PreferredMaintenanceWindow *string    `type:"string"`
+	StorageEncrypted           *bool      `type:"boolean"`
+	Tags                       []*rds.Tag `locationNameList:"Tag" type:"list"`
+	VPCSecurityGroupIDs        []*string  `locationName:"VpcSecurityGroupIds" locationNameList:"VpcSecurityGroupId" type:"list"`
+}
+
+type modifyDBClusterInput struct {
+	AllowMajorVersionUpgrade   *bool   `type:"boolean"`
+	ApplyImmediately           *bool   `type:"boolean"`
+	BackupRetentionPeriod      *int64  `type:"integer"`
+	DBClusterIdentifier        *string `type:"string" required:"true"`
+	EngineVersion              *string `type:"string"`
+	PreferredBackupWindow      *string `type:"string"`
+	PreferredMaintenanceWindow *string `type:"string"`
+}
+
+type deleteDBClusterInput struct {
+	DBClusterIdentifier       *string `type:"string" required:"true"`
+	FinalDBSnapshotIdentifier *string `type:"string"`
+	SkipFinalSnapshot         *bool   `type:"boolean"`
+}
+
+type describeDBClustersInput struct {
+	DBClusterIdentifier *string `type:"string"`
+}
+
+// createDBClusterInstanceInput is the input of CreateDBInstance for the instances of a cluster,
+// the vendored SDK has no DBClusterIdentifier.
+type createDBClusterInstanceInput struct {
+	AutoMinorVersionUpgrade *bool      `type:"boolean"`
+	DBClusterIdentifier     *string    `type:"string"`
+	DBInstanceClass         *string    `type:"string" required:"true"`
+	DBInstanceIdentifier    *string    `type:"string" required:"true"`
+	Engine                  *string    `type:"string" required:"true"`
+	PubliclyAccessible      *bool      `type:"boolean"`
+	Tags                    []*rds.Tag `locationNameList:"Tag" type:"list"`
+}
+
+// dbClusterOutput is the output of CreateDBCluster, ModifyDBCluster and DeleteDBCluster.
+type dbClusterOutput struct {
+	DBCluster *dbCluster `type:"structure"`
+}
+
+type describeDBClustersOutput struct {
+	DBClusters []*dbCluster `locationNameList:"DBCluster" type:"list"`
+}
+
+type dbCluster struct {
+	DBClusterIdentifier *string            `type:"string"`
+	DBClusterMembers    []*dbClusterMember `locationNameList:"DBClusterMember" type:"list"`
+	Endpoint            *string            `type:"string"`
+	EngineVersion       *string            `type:"string"`
+	Port                *int64             `type:"integer"`
+	ReaderEndpoint      *string            `type:"string"`
+	Status              *string            `type:"string"`
+}
+
+type dbClusterMember struct {
+	DBInstanceIdentifier *string `type:"string"`
+	IsClusterWriter      *bool   `type:"boolean"`
+}
+
+// AuroraDBAdapter provisions the instances as Aurora clusters of the InstanceCount instances of their plan.
+// The clusters are named after the database of the instance, as the dedicated instances,
+// and their instances after the cluster, numbered from 1.
+type AuroraDBAdapter struct {
+	InstanceType string
+	AccountId    string
+	Plan         *Plan
+}
+
+// auroraInstanceName returns the RDS identifier of the instance n of the cluster.
+func auroraInstanceName(cluster string, n int) string {
+	return fmt.Sprintf("%s-instance-%d", cluster, n)
+}
+
+func (d *AuroraDBAdapter) CreateDB(i *Instance, password string) (DBInstanceState, error) {
+	if i.SourceSnapshotId != "" || i.SourceDatabase != "" {
+		return InstanceNotCreated, ErrAuroraRestoreNotSupported
+	}
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	// The owner role of the Postgres clusters is created once the cluster is available.
+	i.SetupPending = i.DbType == "postgres"
+
+	params := &createDBClusterInput{
+		DBClusterIdentifier: &i.Database,
+		DatabaseName:        &i.Database,
+		Engine:              aws.String(auroraEngines[i.DbType]),
+		Port:                aws.Long(DefaultPort(i.DbType)),
+		MasterUsername:      &i.Username,
+		MasterUserPassword:  &password,
+		StorageEncrypted:    aws.Boolean(true),
+		Tags:                instanceTags(i),
+		DBSubnetGroupName:   &i.DbSubnetGroup,
+		VPCSecurityGroupIDs: []*string{&i.SecGroup},
+	}
+	// Optional parameters, AWS picks the defaults when they are not set.
+	if i.EngineVersion != "" {
+		params.EngineVersion = &i.EngineVersion
+	}
+	if i.BackupRetentionDays > 0 {
+		params.BackupRetentionPeriod = &i.BackupRetentionDays
+	}
+	if d.Plan.BackupWindow != "" {
+		params.PreferredBackupWindow = &d.Plan.BackupWindow
+	}
+	if d.Plan.MaintenanceWindow != "" {
+		params.PreferredMaintenanceWindow = &d.Plan.MaintenanceWindow
+	}
+
+	resp := &dbClusterOutput{}
+	err := rdsRequest(svc, "CreateDBCluster", params, resp)
+	log.Println(awsutil.StringValue(resp))
+	if err != nil {
+		return InstanceNotCreated, err
+	}
+
+	// The first instance is the writer of the cluster, the others its readers.
+	for n := 1; int64(n) <= d.Plan.InstanceCount; n++ {
+		if err := d.createInstance(svc, i, auroraInstanceName(i.Database, n)); err != nil {
+			d.revertCreateDB(svc, i, n-1)
+			return InstanceNotCreated, err
+		}
+	}
+	return InstanceInProgress, nil
+}
+
+// createInstance adds an instance of the class of the plan to the cluster of the instance.
+func (d *AuroraDBAdapter) createInstance(svc *rds.RDS, i *Instance, name string) error {
+	resp := &rds.CreateDBInstanceOutput{}
+	err := rdsRequest(svc, "CreateDBInstance", &createDBClusterInstanceInput{
+		DBInstanceIdentifier:    aws.String(name),
+		DBClusterIdentifier:     &i.Database,
+		DBInstanceClass:         &d.InstanceType,
+		Engine:                  aws.String(auroraEngines[i.DbType]),
+		AutoMinorVersionUpgrade: d.autoMinorVersionUpgrade(),
+		PubliclyAccessible:      aws.Boolean(false),
+		Tags:                    instanceTags(i),
+	}, resp)
+	log.Println(awsutil.StringValue(resp))
+	return err
+}
+
+// revertCreateDB deletes the cluster of a failed CreateDB and its first created instances,
+// so that nothing is left behind. Failures are logged, the error to report is the one of CreateDB.
+func (d *AuroraDBAdapter) revertCreateDB(svc *rds.RDS, i *Instance, created int) {
+	for n := 1; n <= created; n++ {
+		name := auroraInstanceName(i.Database, n)
+		if err := deleteClusterInstance(svc, name); err != nil {
+			log.Println("Unable to delete the instance " + name + " of a failed creation: " + err.Error())
+		}
+	}
+	err := rdsRequest(svc, "DeleteDBCluster", &deleteDBClusterInput{
+		DBClusterIdentifier: &i.Database,
+		SkipFinalSnapshot:   aws.Boolean(true),
+	}, &dbClusterOutput{})
+	if err != nil {
+		log.Println("Unable to delete the cluster " + i.Database + " of a failed creation: " + err.Error())
+	}
+}
+
+// UpdateDB applies the settings of the plan to the cluster and the class of the plan to its instances,
+// then adds the missing instances or deletes the last readers, the writer is never deleted.
+func (d *AuroraDBAdapter) UpdateDB(i *Instance) (DBInstanceState, error) {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	cluster, err := describeCluster(svc, i.Database)
+	if err != nil {
+		return InstanceNotUpdated, err
+	}
+
+	params := &modifyDBClusterInput{
+		DBClusterIdentifier: &i.Database,
+		ApplyImmediately:    aws.Boolean(true),
+	}
+	if i.BackupRetentionDays > 0 {
+		params.BackupRetentionPeriod = &i.BackupRetentionDays
+	}
+	if d.Plan.BackupWindow != "" {
+		params.PreferredBackupWindow = &d.Plan.BackupWindow
+	}
+	if d.Plan.MaintenanceWindow != "" {
+		params.PreferredMaintenanceWindow = &d.Plan.MaintenanceWindow
+	}
+	// As for the dedicated instances, the engine is only upgraded to a newer version.
+	if i.PlanEngineVersion != "" && cluster.EngineVersion != nil {
+		running := *cluster.EngineVersion
+		if compareEngineVersions(i.PlanEngineVersion, running) > 0 {
+			params.EngineVersion = &i.PlanEngineVersion
+			major := majorEngineVersion(i.DbType, i.PlanEngineVersion) != majorEngineVersion(i.DbType, running)
+			params.AllowMajorVersionUpgrade = aws.Boolean(major)
+			i.EngineVersion = i.PlanEngineVersion
+		}
+	}
+	resp := &dbClusterOutput{}
+	err = rdsRequest(svc, "ModifyDBCluster", params, resp)
+	log.Println(awsutil.StringValue(resp))
+	if err != nil {
+		return InstanceNotUpdated, err
+	}
+
+	var names []string
+	writer := ""
+	for _, member := range cluster.DBClusterMembers {
+		if member.DBInstanceIdentifier == nil {
+			continue
+		}
+		names = append(names, *member.DBInstanceIdentifier)
+		if member.IsClusterWriter != nil && *member.IsClusterWriter {
+			writer = *member.DBInstanceIdentifier
+		}
+	}
+
+	// The readers with the highest numbers are deleted first.
+	for n := auroraMaxInstances; n >= 1 && int64(len(names)) > d.Plan.InstanceCount; n-- {
+		name := auroraInstanceName(i.Database, n)
+		k := indexString(names, name)
+		if k < 0 || name == writer {
+			continue
+		}
+		if err := deleteClusterInstance(svc, name); err != nil {
+			return InstanceNotUpdated, err
+		}
+		names = append(names[:k], names[k+1:]...)
+	}
+
+	for _, name := range names {
+		_, err := svc.ModifyDBInstance(&rds.ModifyDBInstanceInput{
+			DBInstanceIdentifier: aws.String(name),
+			DBInstanceClass:      &d.InstanceType,
+			ApplyImmediately:     aws.Boolean(true),
+		})
+		if err != nil {
+			return InstanceNotUpdated, err
+		}
+	}
+
+	for n := 1; n <= auroraMaxInstances && int64(len(names)) < d.Plan.InstanceCount; n++ {
+		name := auroraInstanceName(i.Database, n)
+		if containsString(names, name) {
+			continue
+		}
+		if err := d.createInstance(svc, i, name); err != nil {
+			return InstanceNotUpdated, err
+		}
+		names = append(names, name)
+	}
+	return InstanceInProgress, nil
+}
+
+// autoMinorVersionUpgrade tells if RDS upgrades the minor versions of the engine, true unless the plan says otherwise.
+func (d *AuroraDBAdapter) autoMinorVersionUpgrade() *bool {
+	if d.Plan.AutoMinorVersionUpgrade != nil {
+		return d.Plan.AutoMinorVersionUpgrade
+	}
+	return aws.Boolean(true)
+}
+
+// GetDBStatus reports the status of the cluster, and once it is available the status of its instances.
+// The cluster is only ready once all of its instances are available.
+func (d *AuroraDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	status := InstanceStatus{
+		State:       InstanceCreationInProgress,
+		Description: "Failed to retrieve state",
+	}
+	cluster, err := describeCluster(svc, i.Database)
+	if err == ErrInstanceNotFound {
+		return InstanceStatus{}, err
+	}
+	if err != nil || cluster.Status == nil {
+		return status, err
+	}
+
+	status.Description = "AWS status: " + *cluster.Status
+	switch *cluster.Status {
+	case "failed", "inaccessible-encryption-credentials", "incompatible-parameters", "incompatible-restore":
+		status.State = InstanceCreationFailed
+		return status, nil
+	case "available":
+	default:
+		return status, nil
+	}
+
+	for _, member := range cluster.DBClusterMembers {
+		if member.DBInstanceIdentifier == nil {
+			continue
+		}
+		resp, err := svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+			DBInstanceIdentifier: member.DBInstanceIdentifier,
+		})
+		if err != nil {
+			return status, err
+		}
+		if len(resp.DBInstances) != 1 || resp.DBInstances[0].DBInstanceStatus == nil {
+			return status, errors.New("The instance " + *member.DBInstanceIdentifier + " of the cluster cannot be found")
+		}
+		memberStatus := *resp.DBInstances[0].DBInstanceStatus
+		switch memberStatus {
+		case "available":
+			continue
+		case "failed", "incompatible-parameters":
+			status.State = InstanceCreationFailed
+		}
+		status.Description = "AWS status of the instance " + *member.DBInstanceIdentifier + ": " + memberStatus
+		return status, nil
+	}
+	status.State = InstanceCreationSucceeded
+	return status, nil
+}
+
+// describeCluster returns the cluster with the identifier, ErrInstanceNotFound if it does not exist (anymore).
+func describeCluster(svc *rds.RDS, identifier string) (*dbCluster, error) {
+	resp := &describeDBClustersOutput{}
+	err := rdsRequest(svc, "DescribeDBClusters", &describeDBClustersInput{
+		DBClusterIdentifier: aws.String(identifier),
+	}, resp)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBClusterNotFoundFault" {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.DBClusters) != 1 {
+		return nil, fmt.Errorf("Failed to retrieve the cluster, %d clusters found", len(resp.DBClusters))
+	}
+	return resp.DBClusters[0], nil
+}
+
+func (d *AuroraDBAdapter) BindDBToApp(i *Instance, password string, b *Binding) (map[string]interface{}, error) {
+	if err := d.loadEndpoints(i); err != nil {
+		return nil, err
+	}
+	conn, err := connectMaster(i, password)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := createMasterBindingUser(conn, i, b); err != nil {
+		return nil, err
+	}
+	return i.GetCredentials(b.Username, b.ClearPassword)
+}
+
+// loadEndpoints records the writer and the reader endpoints and the port of the cluster once it is available.
+func (d *AuroraDBAdapter) loadEndpoints(i *Instance) error {
+	if i.State == InstanceReady && i.Host != "" {
+		return nil
+	}
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	cluster, err := describeCluster(svc, i.Database)
+	if err != nil {
+		return err
+	}
+	if cluster.Status == nil || *cluster.Status != "available" {
+		return errors.New("Instance not available yet. Please wait and try again..")
+	}
+	if cluster.Endpoint == nil || cluster.Port == nil {
+		return errors.New("The cluster has no endpoint")
+	}
+	i.Host = *cluster.Endpoint
+	i.Port = *cluster.Port
+	if cluster.ReaderEndpoint != nil {
+		i.ReaderHost = *cluster.ReaderEndpoint
+	}
+	i.State = InstanceReady
+	return nil
+}
+
+// SetupDB creates the owner role of a Postgres cluster.
+func (d *AuroraDBAdapter) SetupDB(i *Instance, password string) error {
+	if i.DbType != "postgres" {
+		return nil
+	}
+	if err := d.loadEndpoints(i); err != nil {
+		return err
+	}
+	conn, err := connectMaster(i, password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return preparePostgresOwnerRole(conn, i.Username)
+}
+
+func (d *AuroraDBAdapter) UnbindDBFromApp(i *Instance, password string, b *Binding) error {
+	if err := d.loadEndpoints(i); err != nil {
+		return err
+	}
+	conn, err := connectMaster(i, password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return dropMasterBindingUser(conn, i, b)
+}
+
+// DeleteDB deletes the instances of the cluster, then the cluster, which RDS only deletes
+// once its instances are being deleted. The final snapshot is a snapshot of the cluster.
+func (d *AuroraDBAdapter) DeleteDB(i *Instance) (DBInstanceState, error) {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	cluster, err := describeCluster(svc, i.Database)
+	// The cluster is already gone, e.g. its creation failed, so is the instance.
+	if err == ErrInstanceNotFound {
+		return InstanceGone, nil
+	}
+	if err != nil {
+		return InstanceNotGone, err
+	}
+	for _, member := range cluster.DBClusterMembers {
+		if member.DBInstanceIdentifier == nil {
+			continue
+		}
+		if err := deleteClusterInstance(svc, *member.DBInstanceIdentifier); err != nil {
+			return InstanceNotGone, err
+		}
+	}
+
+	params := &deleteDBClusterInput{
+		DBClusterIdentifier: &i.Database,
+		SkipFinalSnapshot:   aws.Boolean(i.FinalSnapshotId == ""),
+	}
+	if i.FinalSnapshotId != "" {
+		params.FinalDBSnapshotIdentifier = aws.String(i.FinalSnapshotId)
+	}
+	resp := &dbClusterOutput{}
+	err = rdsRequest(svc, "DeleteDBCluster", params, resp)
+	log.Println(awsutil.StringValue(resp))
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBClusterNotFoundFault" {
+		return InstanceGone, nil
+	}
+	if err != nil {
+		return InstanceNotGone, err
+	}
+	// RDS takes a while to delete the cluster, it is tracked with GetDBStatus.
+	return InstanceInProgress, nil
+}
+
+// deleteClusterInstance deletes an instance of a cluster, the snapshots are those of the cluster.
+// An instance already gone is skipped.
+func deleteClusterInstance(svc *rds.RDS, name string) error {
+	resp, err := svc.DeleteDBInstance(&rds.DeleteDBInstanceInput{
+		DBInstanceIdentifier: aws.String(name),
+		SkipFinalSnapshot:    aws.Boolean(true),
+	})
+	log.Println(awsutil.StringValue(resp))
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		return nil
+	}
+	return err
+}
+
+// TagFinalSnapshot tags the final snapshot of the cluster with the organization, space and uuid of the instance.
+func (d *AuroraDBAdapter) TagFinalSnapshot(i *Instance) error {
+	if d.AccountId == "" {
+		return errors.New("The AWS account is not set, the snapshots can't be tagged")
+	}
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	_, err := svc.AddTagsToResource(&rds.AddTagsToResourceInput{
+		ResourceName: aws.String(rdsClusterSnapshotArn(i.AwsRegion, d.AccountId, i.FinalSnapshotId)),
+		Tags:         snapshotTags(i),
+	})
+	return err
+}
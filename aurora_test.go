@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/rds"
+
+	"testing"
+)
+
+func TestRDSRequestCreateDBCluster(t *testing.T) {
+	queries, closeServer := rdsTestServer(t, map[string]string{
+		"CreateDBCluster": `<CreateDBClusterResponse xmlns="http://rds.amazonaws.com/doc/2014-10-31/">
+  <CreateDBClusterResult>
+    <DBCluster>
+      <DBClusterIdentifier>db1</DBClusterIdentifier>
+      <Port>5432</Port>
+      <Status>creating</Status>
+    </DBCluster>
+  </CreateDBClusterResult>
+</CreateDBClusterResponse>`,
+	})
+	defer closeServer()
+	svc := rds.New(&aws.Config{Region: "us-east-1"})
+
+	resp := &dbClusterOutput{}
+	err := rdsRequest(svc, "CreateDBCluster", &createDBClusterInput{
+		DBClusterIdentifier: aws.String("db1"),
+		Engine:              aws.String("aurora-postgresql"),
+		Port:                aws.Long(5432),
+		StorageEncrypted:    aws.Boolean(true),
+		Tags:                []*rds.Tag{{Key: aws.String("Owner"), Value: aws.String("Cloud Foundry")}},
+		VPCSecurityGroupIDs: []*string{aws.String("sg-1"), aws.String("sg-2")},
+	}, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*queries) != 1 {
+		t.Fatalf("One request should be sent, not %d", len(*queries))
+	}
+	query := (*queries)[0]
+
+	expected := map[string]string{
+		"Action":                       "CreateDBCluster",
+		"Version":                      "2014-10-31",
+		"DBClusterIdentifier":          "db1",
+		"Engine":                       "aurora-postgresql",
+		"Port":                         "5432",
+		"StorageEncrypted":             "true",
+		"Tags.member.1.Key":            "Owner",
+		"Tags.member.1.Value":          "Cloud Foundry",
+		"VpcSecurityGroupIds.member.1": "sg-1",
+		"VpcSecurityGroupIds.member.2": "sg-2",
+	}
+	for key, value := range expected {
+		if query.Get(key) != value {
+			t.Errorf("The parameter %s should be %q, not %q", key, value, query.Get(key))
+		}
+	}
+	if _, ok := query["DatabaseName"]; ok {
+		t.Error("The parameters not set should not be sent")
+	}
+
+	if resp.DBCluster == nil {
+		t.Fatal("The cluster should be unmarshalled")
+	}
+	if *resp.DBCluster.DBClusterIdentifier != "db1" || *resp.DBCluster.Port != 5432 || *resp.DBCluster.Status != "creating" {
+		t.Errorf("The cluster is not unmarshalled as expected: %s", awsutil.StringValue(resp.DBCluster))
+	}
+}
+
+func TestRDSRequestDescribeDBClusters(t *testing.T) {
+	queries, closeServer := rdsTestServer(t, map[string]string{
+		"DescribeDBClusters": `<DescribeDBClustersResponse xmlns="http://rds.amazonaws.com/doc/2014-10-31/">
+  <DescribeDBClustersResult>
+    <DBClusters>
+      <DBCluster>
+        <DBClusterIdentifier>db1</DBClusterIdentifier>
+        <Endpoint>db1.cluster-abc.us-east-1.rds.amazonaws.com</Endpoint>
+        <ReaderEndpoint>db1.cluster-ro-abc.us-east-1.rds.amazonaws.com</ReaderEndpoint>
+        <EngineVersion>13.7</EngineVersion>
+        <Status>available</Status>
+        <DBClusterMembers>
+          <DBClusterMember>
+            <DBInstanceIdentifier>db1-1</DBInstanceIdentifier>
+            <IsClusterWriter>true</IsClusterWriter>
+          </DBClusterMember>
+          <DBClusterMember>
+            <DBInstanceIdentifier>db1-2</DBInstanceIdentifier>
+            <IsClusterWriter>false</IsClusterWriter>
+          </DBClusterMember>
+        </DBClusterMembers>
+      </DBCluster>
+    </DBClusters>
+  </DescribeDBClustersResult>
+</DescribeDBClustersResponse>`,
+	})
+	defer closeServer()
+	svc := rds.New(&aws.Config{Region: "us-east-1"})
+
+	cluster, err := describeCluster(svc, "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := (*queries)[0]
+	if query.Get("Action") != "DescribeDBClusters" || query.Get("DBClusterIdentifier") != "db1" {
+		t.Errorf("The cluster should be described by its identifier, not with %v", query)
+	}
+	if *cluster.Endpoint != "db1.cluster-abc.us-east-1.rds.amazonaws.com" ||
+		*cluster.ReaderEndpoint != "db1.cluster-ro-abc.us-east-1.rds.amazonaws.com" ||
+		*cluster.EngineVersion != "13.7" || *cluster.Status != "available" {
+		t.Errorf("The cluster is not unmarshalled as expected: %s", awsutil.StringValue(cluster))
+	}
+	if len(cluster.DBClusterMembers) != 2 {
+		t.Fatalf("The cluster should have 2 members, not %d", len(cluster.DBClusterMembers))
+	}
+	if *cluster.DBClusterMembers[0].DBInstanceIdentifier != "db1-1" || !*cluster.DBClusterMembers[0].IsClusterWriter ||
+		*cluster.DBClusterMembers[1].DBInstanceIdentifier != "db1-2" || *cluster.DBClusterMembers[1].IsClusterWriter {
+		t.Errorf("The members of the cluster are not unmarshalled as expected: %s", awsutil.StringValue(cluster.DBClusterMembers))
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -29,27 +33,75 @@ type PlanMetadata struct {
 	DisplayName string     `yaml:"displayName" json:"displayName"`
 }
 
+// PlanSchemas holds the schemas of the parameters accepted by a plan.
+type PlanSchemas struct {
+	ServiceInstance ServiceInstanceSchemas `yaml:"serviceInstance" json:"service_instance"`
+}
+
+type ServiceInstanceSchemas struct {
+	Create *InputParametersSchema `yaml:"create" json:"create,omitempty"`
+	Update *InputParametersSchema `yaml:"update" json:"update,omitempty"`
+}
+
+type InputParametersSchema struct {
+	Parameters *JSONSchema `yaml:"parameters" json:"parameters"`
+}
+
 type Plan struct {
-	Id           string       `yaml:"id" json:"id"`
-	Name         string       `yaml:"name" json:"name"`
-	Description  string       `yaml:"description" json:"description"`
-	Metadata     PlanMetadata `yaml:"metadata" json:"metadata"`
-	Free         bool         `yaml:"free" json:"free"`
-	Adapter      string       `yaml:"adapter" json:"-"`
-	InstanceType string       `yaml:"instanceType" json:"-"`
-	DbType       string       `yaml:"dbType" json:"-"`
-	DbStorage    int64        `yaml:"dbStorage" json:"-"`
-	MultiAz      bool         `yaml:"multiAz" json:"multiAz"`
+	Id             string       `yaml:"id" json:"id"`
+	Name           string       `yaml:"name" json:"name"`
+	Description    string       `yaml:"description" json:"description"`
+	Metadata       PlanMetadata `yaml:"metadata" json:"metadata"`
+	Free           bool         `yaml:"free" json:"free"`
+	PlanUpdateable bool         `yaml:"planUpdateable" json:"plan_updateable"`
+	Adapter        string       `yaml:"adapter" json:"-"`
+	InstanceType   string       `yaml:"instanceType" json:"-"`
+	DbType         string       `yaml:"dbType" json:"-"`
+	DbStorage      int64        `yaml:"dbStorage" json:"-"`
+	MultiAz        bool         `yaml:"multiAz" json:"multiAz"`
+	Schemas        *PlanSchemas `yaml:"schemas" json:"schemas,omitempty"`
+	// FinalSnapshot tells if RDS takes a snapshot of the dedicated instances when they are deleted.
+	// It can be overridden with the final_snapshot parameter of the deletion.
+	FinalSnapshot bool `yaml:"finalSnapshot" json:"-"`
+	// ServerTags are the tags a shared server needs to host the instances of the plan.
+	ServerTags []string `yaml:"serverTags" json:"-"`
+	// Limits of the roles of the shared Postgres instances, none if empty.
+	ConnectionLimit                 int64  `yaml:"connectionLimit" json:"-"`
+	StatementTimeout                string `yaml:"statementTimeout" json:"-"`
+	IdleInTransactionSessionTimeout string `yaml:"idleInTransactionSessionTimeout" json:"-"`
+	// ReadReplicas is the number of read replicas of the dedicated instances.
+	ReadReplicas int64 `yaml:"readReplicas" json:"-"`
+	// InstanceCount is the number of instances of the Aurora clusters, a writer and its readers.
+	// They all get the InstanceType of the plan.
+	InstanceCount int64 `yaml:"instanceCount" json:"-"`
+	// Settings of the dedicated instances, AWS picks the defaults of those not set.
+	// They are checked when the catalog is loaded.
+	EngineVersion           string `yaml:"engineVersion" json:"-"`
+	BackupRetentionDays     int64  `yaml:"backupRetentionDays" json:"-"`
+	BackupWindow            string `yaml:"backupWindow" json:"-"`
+	MaintenanceWindow       string `yaml:"maintenanceWindow" json:"-"`
+	StorageType             string `yaml:"storageType" json:"-"`
+	Iops                    int64  `yaml:"iops" json:"-"`
+	AutoMinorVersionUpgrade *bool  `yaml:"autoMinorVersionUpgrade" json:"-"`
+	// MaxAllocatedStorage is the storage in GB up to which RDS grows the storage of the dedicated instances,
+	// no storage autoscaling if zero.
+	MaxAllocatedStorage int64 `yaml:"maxAllocatedStorage" json:"-"`
+	// ParameterGroup is the DB parameter group of the dedicated instances.
+	// The instances setting engine parameters get a copy of it.
+	ParameterGroup string `yaml:"parameterGroup" json:"-"`
 }
 
 type Service struct {
-	Id          string          `yaml:"id" json:"id"`
-	Name        string          `yaml:"name" json:"name"`
-	Description string          `yaml:"description" json:"description"`
-	Bindable    bool            `yaml:"bindable" json:"bindable"`
-	Tags        []string        `yaml:"tags" json:"tags"`
-	Metadata    ServiceMetadata `yaml:"metadata" json:"metadata"`
-	Plans       []Plan          `yaml:"plans" json:"plans"`
+	Id                   string          `yaml:"id" json:"id"`
+	Name                 string          `yaml:"name" json:"name"`
+	Description          string          `yaml:"description" json:"description"`
+	Bindable             bool            `yaml:"bindable" json:"bindable"`
+	PlanUpdateable       bool            `yaml:"planUpdateable" json:"plan_updateable"`
+	InstancesRetrievable bool            `yaml:"instancesRetrievable" json:"instances_retrievable"`
+	BindingsRetrievable  bool            `yaml:"bindingsRetrievable" json:"bindings_retrievable"`
+	Tags                 []string        `yaml:"tags" json:"tags"`
+	Metadata             ServiceMetadata `yaml:"metadata" json:"metadata"`
+	Plans                []Plan          `yaml:"plans" json:"plans"`
 }
 
 // Catalog struct holds a collections of services
@@ -71,9 +123,25 @@ func initCatalog() *Catalog {
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
+	if err = catalog.validate(); err != nil {
+		log.Fatalf("error: %v", err)
+	}
 	return &catalog
 }
 
+// validate checks the settings of the plans, so that a wrong catalog fails when the broker starts
+// rather than when an instance is created.
+func (catalog *Catalog) validate() error {
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			if err := plan.validate(); err != nil {
+				return fmt.Errorf("plan %s: %v", plan.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
 // fetchService returns a pointer to the Service struct with the given service ID
 func (catalog *Catalog) fetchService(serviceID string) *Service {
 	for _, service := range catalog.Services {
@@ -96,3 +164,218 @@ func (catalog *Catalog) fetchPlan(serviceID string, planID string) *Plan {
 	}
 	return nil
 }
+
+// RDS values of the settings of the plans.
+var (
+	rdsEngineVersion   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+	rdsBackupWindow    = regexp.MustCompile(`^([0-9]{2}:[0-9]{2})-([0-9]{2}:[0-9]{2})$`)
+	rdsMaintenanceDays = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+	rdsStorageTypes    = []string{"standard", "gp2", "gp3", "io1"}
+)
+
+// auroraEngineVersion matches the versions of the Aurora plans, those of Aurora MySQL end with the version of Aurora,
+// e.g. 5.7.mysql_aurora.2.11.2.
+var auroraEngineVersion = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*(\.mysql_aurora(\.[0-9]+)+)?$`)
+
+// rdsMinWindow is the minimum length of the backup and maintenance windows in minutes.
+const rdsMinWindow = 30
+
+// rdsMaxStorage is the maximum storage of an RDS instance in GB.
+const rdsMaxStorage = 65536
+
+func (plan *Plan) validate() error {
+	if plan.Adapter != AdapterAurora && plan.InstanceCount != 0 {
+		return fmt.Errorf("instanceCount only applies to the %s plans", AdapterAurora)
+	}
+	switch plan.Adapter {
+	case AdapterDedicated:
+	case AdapterAurora:
+		// Aurora manages the storage of the clusters, their readers are the instances of the cluster.
+		if plan.StorageType != "" || plan.Iops != 0 || plan.MaxAllocatedStorage != 0 || plan.ReadReplicas != 0 || plan.ParameterGroup != "" {
+			return fmt.Errorf("storageType, iops, maxAllocatedStorage, readReplicas and parameterGroup do not apply to the %s plans", AdapterAurora)
+		}
+		if plan.DbType != "postgres" && plan.DbType != "mysql" {
+			return fmt.Errorf("dbType must be postgres or mysql")
+		}
+		if plan.InstanceType == "" {
+			return fmt.Errorf("instanceType must be set")
+		}
+		if plan.InstanceCount < 1 || plan.InstanceCount > 16 {
+			return fmt.Errorf("instanceCount must be between 1 and 16")
+		}
+	default:
+		if plan.EngineVersion != "" || plan.BackupRetentionDays != 0 || plan.BackupWindow != "" || plan.MaintenanceWindow != "" ||
+			plan.StorageType != "" || plan.Iops != 0 || plan.MaxAllocatedStorage != 0 || plan.AutoMinorVersionUpgrade != nil ||
+			plan.ReadReplicas != 0 || plan.ParameterGroup != "" {
+			return fmt.Errorf("the RDS settings only apply to the %s and %s plans", AdapterDedicated, AdapterAurora)
+		}
+		return nil
+	}
+
+	engineVersion := rdsEngineVersion
+	if plan.Adapter == AdapterAurora {
+		engineVersion = auroraEngineVersion
+	}
+	if plan.EngineVersion != "" && !engineVersion.MatchString(plan.EngineVersion) {
+		return fmt.Errorf("engineVersion %q is not a version", plan.EngineVersion)
+	}
+	if plan.BackupRetentionDays < 0 || plan.BackupRetentionDays > 35 {
+		return fmt.Errorf("backupRetentionDays must be between 0 and 35")
+	}
+	if plan.ReadReplicas < 0 || plan.ReadReplicas > 5 {
+		return fmt.Errorf("readReplicas must be between 0 and 5")
+	}
+
+	var backupStart, backupLength, maintenanceStart, maintenanceLength int
+	var err error
+	if plan.BackupWindow != "" {
+		if backupStart, backupLength, err = parseBackupWindow(plan.BackupWindow); err != nil {
+			return fmt.Errorf("backupWindow %v", err)
+		}
+	}
+	if plan.MaintenanceWindow != "" {
+		if maintenanceStart, maintenanceLength, err = parseMaintenanceWindow(plan.MaintenanceWindow); err != nil {
+			return fmt.Errorf("maintenanceWindow %v", err)
+		}
+	}
+	// The daily backup window can't overlap the weekly maintenance window.
+	if backupLength > 0 && maintenanceLength > 0 {
+		for day := 0; day < 7; day++ {
+			if windowsOverlap(day*24*60+backupStart, backupLength, maintenanceStart, maintenanceLength, 7*24*60) {
+				return fmt.Errorf("backupWindow and maintenanceWindow must not overlap")
+			}
+		}
+	}
+
+	if err := checkStorage(plan.StorageType, plan.Iops, "storageType", "iops"); err != nil {
+		return err
+	}
+	return checkMaxAllocatedStorage(plan.MaxAllocatedStorage, plan.DbStorage, "maxAllocatedStorage")
+}
+
+// checkStorage checks the RDS storage type and the provisioned IOPS of a plan or an instance,
+// named storageTypeName and iopsName in the errors.
+func checkStorage(storageType string, iops int64, storageTypeName, iopsName string) error {
+	if storageType != "" && !containsString(rdsStorageTypes, storageType) {
+		return fmt.Errorf("%s must be one of %s", storageTypeName, strings.Join(rdsStorageTypes, ", "))
+	}
+	switch {
+	case storageType == "io1" && iops < 1000:
+		return fmt.Errorf("%s must be at least 1000 for the io1 storage", iopsName)
+	case iops < 0, iops > 0 && storageType != "io1" && storageType != "gp3":
+		return fmt.Errorf("%s can only be set for the io1 and gp3 storages", iopsName)
+	}
+	return nil
+}
+
+// checkMaxAllocatedStorage checks the storage autoscaling limit of a plan or an instance, named name in the errors.
+// RDS only grows the storage, the limit can't be below the allocated storage.
+func checkMaxAllocatedStorage(maxStorage, storage int64, name string) error {
+	if maxStorage != 0 && maxStorage < storage {
+		return fmt.Errorf("%s must be at least the allocated storage, %d GB", name, storage)
+	}
+	if maxStorage < 0 || maxStorage > rdsMaxStorage {
+		return fmt.Errorf("%s must be at most %d GB", name, rdsMaxStorage)
+	}
+	return nil
+}
+
+// parseBackupWindow parses a daily window, hh24:mi-hh24:mi in UTC, and returns its start in minutes
+// from midnight and its length in minutes.
+func parseBackupWindow(window string) (int, int, error) {
+	parts := rdsBackupWindow.FindStringSubmatch(window)
+	if parts == nil {
+		return 0, 0, fmt.Errorf("%q must be hh24:mi-hh24:mi", window)
+	}
+	start, ok := parseWindowTime(parts[1])
+	end, ok2 := parseWindowTime(parts[2])
+	if !ok || !ok2 {
+		return 0, 0, fmt.Errorf("%q is not a valid time range", window)
+	}
+	return checkWindowLength(window, start, end, 24*60)
+}
+
+// parseMaintenanceWindow parses a weekly window, ddd:hh24:mi-ddd:hh24:mi in UTC, and returns its start in minutes
+// from Monday midnight and its length in minutes.
+func parseMaintenanceWindow(window string) (int, int, error) {
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("%q must be ddd:hh24:mi-ddd:hh24:mi", window)
+	}
+	var minutes [2]int
+	for k, bound := range bounds {
+		if len(bound) != len("mon:00:00") || bound[3] != ':' {
+			return 0, 0, fmt.Errorf("%q must be ddd:hh24:mi-ddd:hh24:mi", window)
+		}
+		day := indexString(rdsMaintenanceDays, strings.ToLower(bound[:3]))
+		at, ok := parseWindowTime(bound[4:])
+		if day < 0 || !ok {
+			return 0, 0, fmt.Errorf("%q is not a valid time range", window)
+		}
+		minutes[k] = day*24*60 + at
+	}
+	return checkWindowLength(window, minutes[0], minutes[1], 7*24*60)
+}
+
+// parseWindowTime parses hh24:mi and returns the minutes from midnight.
+func parseWindowTime(value string) (int, bool) {
+	if len(value) != len("00:00") || value[2] != ':' {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(value[:2])
+	if err != nil || hours > 23 {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(value[3:])
+	if err != nil || minutes > 59 {
+		return 0, false
+	}
+	return hours*60 + minutes, true
+}
+
+// checkWindowLength returns the start and the length of a window repeated every period minutes.
+func checkWindowLength(window string, start, end, period int) (int, int, error) {
+	length := (end - start + period) % period
+	if length < rdsMinWindow {
+		return 0, 0, fmt.Errorf("%q must be at least %d minutes long", window, rdsMinWindow)
+	}
+	return start, length, nil
+}
+
+// windowsOverlap tells if two windows repeated every period minutes overlap.
+func windowsOverlap(startA, lengthA, startB, lengthB, period int) bool {
+	return (startB-startA+period)%period < lengthA || (startA-startB+period)%period < lengthB
+}
+
+func indexString(values []string, value string) int {
+	for k, v := range values {
+		if v == value {
+			return k
+		}
+	}
+	return -1
+}
+
+func containsString(values []string, value string) bool {
+	return indexString(values, value) >= 0
+}
+
+// validateCreateParameters checks the raw parameters of a new instance against the create schema of the plan.
+// Plans without a schema do not accept any parameter.
+func (plan *Plan) validateCreateParameters(raw []byte) error {
+	schema := &JSONSchema{Type: "object", AdditionalProperties: new(bool)}
+	if plan.Schemas != nil && plan.Schemas.ServiceInstance.Create != nil {
+		schema = plan.Schemas.ServiceInstance.Create.Parameters
+	}
+	return schema.ValidateJSON("parameters", raw)
+}
+
+// validateUpdateParameters checks the raw parameters of an instance update against the update schema of the plan.
+// Plans without a schema do not accept any parameter.
+func (plan *Plan) validateUpdateParameters(raw []byte) error {
+	schema := &JSONSchema{Type: "object", AdditionalProperties: new(bool)}
+	if plan.Schemas != nil && plan.Schemas.ServiceInstance.Update != nil {
+		schema = plan.Schemas.ServiceInstance.Update.Parameters
+	}
+	return schema.ValidateJSON("parameters", raw)
+}
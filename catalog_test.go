@@ -41,3 +41,57 @@ func TestFetchService(t *testing.T) {
 		t.Error("Found the wrong service")
 	}
 }
+
+func TestPlanValidate(t *testing.T) {
+	if err := catalog.validate(); err != nil {
+		t.Error("The catalog should be valid and it is not:", err)
+	}
+
+	valid := []Plan{
+		{Adapter: AdapterDedicated},
+		{Adapter: AdapterDedicated, EngineVersion: "9.4.7", BackupRetentionDays: 14, StorageType: "gp2"},
+		{Adapter: AdapterDedicated, BackupWindow: "23:45-00:15", MaintenanceWindow: "sun:03:00-sun:04:00"},
+		{Adapter: AdapterDedicated, MaintenanceWindow: "sun:23:30-mon:00:30"},
+		{Adapter: AdapterDedicated, StorageType: "io1", Iops: 1000},
+		{Adapter: AdapterDedicated, DbStorage: 10, MaxAllocatedStorage: 100},
+		{Adapter: AdapterShared},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceType: "db.r5.large", InstanceCount: 2, EngineVersion: "13.7"},
+		{Adapter: AdapterAurora, DbType: "mysql", InstanceType: "db.r5.large", InstanceCount: 1, EngineVersion: "5.7.mysql_aurora.2.11.2"},
+	}
+	for _, plan := range valid {
+		if err := plan.validate(); err != nil {
+			t.Errorf("The plan %+v should be valid and it is not: %v", plan, err)
+		}
+	}
+
+	invalid := []Plan{
+		{Adapter: AdapterDedicated, EngineVersion: "latest"},
+		{Adapter: AdapterDedicated, BackupRetentionDays: 36},
+		{Adapter: AdapterDedicated, BackupWindow: "03:00-03:15"},
+		{Adapter: AdapterDedicated, BackupWindow: "25:00-26:00"},
+		{Adapter: AdapterDedicated, MaintenanceWindow: "sun:03:00"},
+		{Adapter: AdapterDedicated, MaintenanceWindow: "day:03:00-day:04:00"},
+		{Adapter: AdapterDedicated, BackupWindow: "03:00-04:00", MaintenanceWindow: "wed:03:30-wed:04:30"},
+		{Adapter: AdapterDedicated, StorageType: "ssd"},
+		{Adapter: AdapterDedicated, StorageType: "io1"},
+		{Adapter: AdapterDedicated, StorageType: "gp2", Iops: 1000},
+		{Adapter: AdapterShared, BackupRetentionDays: 14},
+		{Adapter: AdapterShared, MaxAllocatedStorage: 100},
+		{Adapter: AdapterDedicated, DbStorage: 100, MaxAllocatedStorage: 50},
+		{Adapter: AdapterDedicated, DbStorage: 100, MaxAllocatedStorage: 100000},
+		{Adapter: AdapterDedicated, InstanceCount: 2},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceType: "db.r5.large"},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceType: "db.r5.large", InstanceCount: 17},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceCount: 2},
+		{Adapter: AdapterAurora, DbType: "mariadb", InstanceType: "db.r5.large", InstanceCount: 2},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceType: "db.r5.large", InstanceCount: 2, ReadReplicas: 1},
+		{Adapter: AdapterAurora, DbType: "mysql", InstanceType: "db.r5.large", InstanceCount: 2, EngineVersion: "latest"},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceType: "db.r5.large", InstanceCount: 2, ParameterGroup: "custom-postgres13"},
+		{Adapter: AdapterAurora, DbType: "postgres", InstanceType: "db.r5.large", InstanceCount: 2, MaxAllocatedStorage: 100},
+	}
+	for _, plan := range invalid {
+		if err := plan.validate(); err == nil {
+			t.Errorf("The plan %+v should not be valid", plan)
+		}
+	}
+}
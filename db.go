@@ -1,6 +1,7 @@
 package main
 
 import (
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -8,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 )
 
 // DBConfig holds configuration information to connect to a database.
@@ -17,7 +19,7 @@ import (
 // * password - The user's password
 // * host - The host to connect to. Values that start with / are for unix domain sockets.
 //   (default is localhost)
-// * port - The port to bind to. (default is 5432)
+// * port - The port to bind to. (default is 5432 for postgres and 3306 for mysql and mariadb)
 // * sslmode - Whether or not to use SSL (default is require, this is not the default for libpq)
 //   Valid SSL modes:
 //    * disable - No SSL
@@ -33,9 +35,31 @@ type DBConfig struct {
 	Port     int64   // Is int64 to match the type that rds.Endpoint.Port is in the AWS RDS SDK.
 }
 
+// DefaultPort returns the port the given type of database listens to by default.
+func DefaultPort(dbType string) int64 {
+	switch dbType {
+	case "mysql", "mariadb":
+		return 3306
+	}
+	return 5432
+}
+
+// mysqlTLS translates an SSL mode to the tls parameter of the MySQL driver.
+func mysqlTLS(sslmode string) string {
+	switch sslmode {
+	case "disable":
+		return "false"
+	case "require", "":
+		return "skip-verify"
+	}
+	return "true"
+}
+
 // DBinit is a generic helper function that will try to connect to a database with the config in the input.
 // Supported DB types:
 // * postgres
+// * mysql
+// * mariadb (with the mysql driver)
 // * sqlite3
 func DBInit(dbConfig *DBConfig) (*gorm.DB, error) {
 	var DB gorm.DB
@@ -51,6 +75,16 @@ func DBInit(dbConfig *DBConfig) (*gorm.DB, error) {
 			dbConfig.Sslmode,
 			dbConfig.Port)
 		DB, err = gorm.Open("postgres", conn)
+	case "mysql", "mariadb":
+		conn := "%s:%s@tcp(%s:%d)/%s?tls=%s&parseTime=true"
+		conn = fmt.Sprintf(conn,
+			dbConfig.Username,
+			dbConfig.Password,
+			dbConfig.Url,
+			dbConfig.Port,
+			dbConfig.DbName,
+			mysqlTLS(dbConfig.Sslmode))
+		DB, err = gorm.Open("mysql", conn)
 	case "sqlite3":
 		DB, err = gorm.Open("sqlite3", dbConfig.DbName)
 	default:
@@ -71,15 +105,59 @@ func DBInit(dbConfig *DBConfig) (*gorm.DB, error) {
 }
 
 // InternalDBInit initializes the internal database connection that the service broker will use.
-// In addition to calling DBInit(), it also makes sure that the tables are setup for Instance and DBConfig structs.
+// In addition to calling DBInit(), it also makes sure that the tables are setup for Instance, Binding, AuditEvent, InstanceLock and DBConfig structs.
 func InternalDBInit(dbConfig *DBConfig) (*gorm.DB, error) {
 	db, err := DBInit(dbConfig)
 	if err == nil {
 		db.DB().SetMaxOpenConns(10)
 		log.Println("Migrating")
 		// Automigrate!
-		db.AutoMigrate(Instance{}) // Add all your models here to help setup the database tables.
+		db.AutoMigrate(Instance{}, Binding{}, AuditEvent{}, InstanceLock{}, SharedServer{}) // Add all your models here to help setup the database tables.
 		log.Println("Migrated")
 	}
 	return db, err
 }
+
+// sharedConnections holds the connections to the shared database servers, by server.
+var sharedConnections = struct {
+	sync.Mutex
+	conns map[string]*gorm.DB
+}{conns: map[string]*gorm.DB{}}
+
+// SharedDBConn returns a connection to the shared database server of the config.
+// The connection is opened on first use and reused afterwards.
+func SharedDBConn(dbConfig *DBConfig) (*gorm.DB, error) {
+	key := sharedDBConnKey(dbConfig)
+
+	sharedConnections.Lock()
+	defer sharedConnections.Unlock()
+	if db, ok := sharedConnections.conns[key]; ok {
+		return db, nil
+	}
+	db, err := DBInit(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	sharedConnections.conns[key] = db
+	return db, nil
+}
+
+// CloseSharedDBConn closes the connection to the shared database server of the config, if one is open,
+// so that the next SharedDBConn opens a new one, e.g. once the password of the server changed.
+func CloseSharedDBConn(dbConfig *DBConfig) error {
+	key := sharedDBConnKey(dbConfig)
+
+	sharedConnections.Lock()
+	defer sharedConnections.Unlock()
+	db, ok := sharedConnections.conns[key]
+	if !ok {
+		return nil
+	}
+	delete(sharedConnections.conns, key)
+	return db.Close()
+}
+
+// sharedDBConnKey identifies the server of the config, the connections are not told apart by password.
+func sharedDBConnKey(dbConfig *DBConfig) string {
+	return fmt.Sprintf("%s://%s@%s:%d/%s", dbConfig.DbType, dbConfig.Username, dbConfig.Url, dbConfig.Port, dbConfig.DbName)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSharedDBConn(t *testing.T) {
+	dbConfig := DBConfig{DbType: "sqlite3", DbName: ":memory:"}
+
+	conn, err := SharedDBConn(&dbConfig)
+	if err != nil {
+		t.Fatal("Unable to connect to the shared database:", err)
+	}
+
+	again, _ := SharedDBConn(&DBConfig{DbType: "sqlite3", DbName: ":memory:"})
+	if again != conn {
+		t.Error("The connection to the same server should be reused")
+	}
+
+	other, _ := SharedDBConn(&DBConfig{DbType: "sqlite3", DbName: "file::memory:"})
+	if other == conn {
+		t.Error("Each server should have its own connection")
+	}
+
+	if _, err := SharedDBConn(&DBConfig{DbType: "oracle"}); err == nil {
+		t.Error("An unsupported server should not be connected to")
+	}
+}
+
+func TestCloseSharedDBConn(t *testing.T) {
+	dbConfig := DBConfig{DbType: "sqlite3", DbName: "file::memory:?cache=shared", Password: "old"}
+	conn, err := SharedDBConn(&dbConfig)
+	if err != nil {
+		t.Fatal("Unable to connect to the shared database:", err)
+	}
+
+	dbConfig.Password = "new"
+	if err := CloseSharedDBConn(&dbConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.DB().Ping(); err == nil {
+		t.Error("The connection with the previous password should be closed")
+	}
+	again, err := SharedDBConn(&dbConfig)
+	if err != nil || again == conn {
+		t.Error("A new connection should be opened with the new password")
+	}
+
+	if err := CloseSharedDBConn(&DBConfig{DbType: "sqlite3", DbName: "unknown"}); err != nil {
+		t.Error("Closing a server never connected to should do nothing, not fail with", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// OriginatingIdentityHeader is the header the platforms use to tell which user triggered a request.
+// Its value is the platform followed by a base64 encoded JSON object, eg.
+// cloudfoundry eyJ1c2VyX2lkIjoiNjgzZWE3NDgtMzA5Mi00ZmY0LWI2NTYtMzljYWNjNGQ1MzYwIn0=
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// OriginatingIdentity is the user that triggered a request on the platform.
+// It is empty when the platform did not send the header.
+type OriginatingIdentity struct {
+	Platform string
+	Value    map[string]interface{}
+}
+
+// ParseOriginatingIdentity decodes the value of the originating identity header.
+// Supported platforms:
+// * cloudfoundry - The value must have a user_id
+// * kubernetes - The value must have a username
+// Other platforms are accepted as is.
+func ParseOriginatingIdentity(header string) (OriginatingIdentity, error) {
+	var identity OriginatingIdentity
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return identity, errors.New("The originating identity must be a platform and a value")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return identity, errors.New("The originating identity value is not base64 encoded")
+	}
+	if err = json.Unmarshal(decoded, &identity.Value); err != nil {
+		return identity, errors.New("The originating identity value is not a JSON object")
+	}
+	identity.Platform = parts[0]
+
+	switch identity.Platform {
+	case "cloudfoundry", "kubernetes":
+		if identity.User() == "" {
+			return identity, errors.New("The originating identity has no user for platform " + identity.Platform)
+		}
+	}
+	return identity, nil
+}
+
+// User returns the user of the identity on its platform.
+func (o OriginatingIdentity) User() string {
+	var user interface{}
+	switch o.Platform {
+	case "cloudfoundry":
+		user = o.Value["user_id"]
+	case "kubernetes":
+		user = o.Value["username"]
+	}
+	if s, ok := user.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// JSON returns the decoded value of the identity as JSON.
+func (o OriginatingIdentity) JSON() string {
+	if o.Value == nil {
+		return ""
+	}
+	b, _ := json.Marshal(o.Value)
+	return string(b)
+}
+
+// OriginatingIdentityHandler is a middleware that maps the OriginatingIdentity of the request for the handlers.
+func OriginatingIdentityHandler() martini.Handler {
+	return func(req *http.Request, c martini.Context, r render.Render) {
+		var identity OriginatingIdentity
+		if header := req.Header.Get(OriginatingIdentityHeader); header != "" {
+			var err error
+			if identity, err = ParseOriginatingIdentity(header); err != nil {
+				r.JSON(http.StatusBadRequest, Response{err.Error()})
+				return
+			}
+		}
+		c.Map(identity)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte(`{"user_id":"a-user"}`))
+	identity, err := ParseOriginatingIdentity("cloudfoundry " + value)
+	if err != nil || identity.Platform != "cloudfoundry" || identity.User() != "a-user" {
+		t.Error("The cloudfoundry identity should be parsed and it returned", identity, err)
+	}
+
+	value = base64.StdEncoding.EncodeToString([]byte(`{"username":"a-user","uid":"1234","groups":["admin"]}`))
+	identity, err = ParseOriginatingIdentity("kubernetes " + value)
+	if err != nil || identity.Platform != "kubernetes" || identity.User() != "a-user" {
+		t.Error("The kubernetes identity should be parsed and it returned", identity, err)
+	}
+
+	if identity.JSON() != `{"groups":["admin"],"uid":"1234","username":"a-user"}` {
+		t.Error("The identity should be encoded as JSON and it returned", identity.JSON())
+	}
+}
+
+func TestParseInvalidOriginatingIdentity(t *testing.T) {
+	invalid := []string{
+		"cloudfoundry",
+		"cloudfoundry not-base64!",
+		"cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`"a-user"`)),
+		"cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"username":"a-user"}`)),
+		"kubernetes " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"a-user"}`)),
+	}
+	for _, header := range invalid {
+		if _, err := ParseOriginatingIdentity(header); err == nil {
+			t.Error(header, "should not be parsed")
+		}
+	}
+}
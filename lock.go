@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+	"github.com/martini-contrib/render"
+
+	"time"
+)
+
+// InstanceLockTimeout is how long a lock is held at most.
+// Locks older than that were left behind by a broker that went away in the middle of a request.
+var InstanceLockTimeout = 5 * time.Minute
+
+// InstanceLock marks an operation in flight on an instance.
+// The instance uuid is unique, so only one broker process can hold the lock of an instance at a time.
+type InstanceLock struct {
+	Id           int64
+	InstanceUuid string `sql:"size(255);unique"`
+	Operation    string `sql:"size(255)"`
+	// Token tells the lock apart from a later lock of the instance, which may get the same id once it is deleted.
+	Token     string `sql:"size(255)"`
+	CreatedAt time.Time
+}
+
+// AcquireInstanceLock tries to take the lock of the instance for the operation.
+// It returns nil if another operation holds it, otherwise the lock to release once the operation is done.
+func AcquireInstanceLock(brokerDb *gorm.DB, uuid string, operation string) *InstanceLock {
+	brokerDb.Where("instance_uuid = ? AND created_at < ?", uuid, time.Now().Add(-InstanceLockTimeout)).Delete(InstanceLock{})
+	lock := &InstanceLock{InstanceUuid: uuid, Operation: operation, Token: randStr(20)}
+	if brokerDb.Create(lock).Error != nil {
+		return nil
+	}
+	return lock
+}
+
+// ReleaseInstanceLock releases the lock. A lock which expired and was taken by another operation since
+// is left to that operation.
+func ReleaseInstanceLock(brokerDb *gorm.DB, lock *InstanceLock) {
+	brokerDb.Where("id = ? AND token = ?", lock.Id, lock.Token).Delete(InstanceLock{})
+}
+
+// concurrencyError tells the platform to retry once the other operation is done.
+func concurrencyError(r render.Render) {
+	// UNPROCESSABLE_ENTITY
+	r.JSON(422, ErrorResponse{Error: "ConcurrencyError", Description: "Another operation for this service instance is in progress."})
+}
+
+// InstanceLockHandler is a middleware that holds the lock of the instance in the given route parameter
+// while the request is handled. Concurrent requests for the same instance get a ConcurrencyError.
+func InstanceLockHandler(param string, operation string) martini.Handler {
+	return func(p martini.Params, c martini.Context, r render.Render, brokerDb *gorm.DB) {
+		lock := AcquireInstanceLock(brokerDb, p[param], operation)
+		if lock == nil {
+			concurrencyError(r)
+			return
+		}
+		defer ReleaseInstanceLock(brokerDb, lock)
+		c.Next()
+	}
+}
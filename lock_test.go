@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInstanceLock(t *testing.T) {
+	setup()
+
+	lock := AcquireInstanceLock(brokerDB, "the_instance", "bind")
+	if lock == nil {
+		t.Fatal("The lock should be acquired")
+	}
+
+	if AcquireInstanceLock(brokerDB, "the_instance", "delete") != nil {
+		t.Error("The lock should not be acquired twice")
+	}
+
+	if AcquireInstanceLock(brokerDB, "another_instance", "bind") == nil {
+		t.Error("The lock of another instance should be acquired")
+	}
+
+	ReleaseInstanceLock(brokerDB, lock)
+
+	if AcquireInstanceLock(brokerDB, "the_instance", "delete") == nil {
+		t.Error("The lock should be acquired once released")
+	}
+}
+
+func TestInstanceLockExpires(t *testing.T) {
+	setup()
+
+	expired := AcquireInstanceLock(brokerDB, "the_instance", "bind")
+	brokerDB.Model(InstanceLock{}).Where("instance_uuid = ?", "the_instance").
+		UpdateColumn("created_at", time.Now().Add(-2*InstanceLockTimeout))
+
+	if AcquireInstanceLock(brokerDB, "the_instance", "delete") == nil {
+		t.Error("An expired lock should be acquired")
+	}
+
+	// The operation which held the expired lock does not release the lock of the new one.
+	ReleaseInstanceLock(brokerDB, expired)
+	if AcquireInstanceLock(brokerDB, "the_instance", "bind") != nil {
+		t.Error("The lock of the new operation should not be released by the old one")
+	}
+}
@@ -26,6 +26,9 @@ func main() {
 		return
 	}
 
+	// Enforce the storage of the shared instances.
+	StartQuotaChecker(&settings, DB, initCatalog(), settings.QuotaCheckInterval)
+
 	// Try to connect and create the app.
 	if m := App(&settings, DB); m != nil {
 		log.Println("Starting app...")
@@ -41,8 +44,10 @@ func App(settings *Settings, DB *gorm.DB) *martini.ClassicMartini {
 
 	username := os.Getenv("AUTH_USER")
 	password := os.Getenv("AUTH_PASS")
+	// The admin API has its own credentials, those of the platform don't give access to it.
+	adminUsername := os.Getenv("ADMIN_USER")
+	adminPassword := os.Getenv("ADMIN_PASS")
 
-	m.Use(auth.Basic(username, password))
 	m.Use(render.Renderer())
 
 	m.Map(DB)
@@ -51,27 +56,48 @@ func App(settings *Settings, DB *gorm.DB) *martini.ClassicMartini {
 
 	log.Println("Loading Routes")
 
-	// Serve the catalog with services and plans
-	m.Get("/v2/catalog", func(r render.Render, catalog *Catalog) {
-		r.JSON(200, catalog)
-	})
-
-	// Create the service instance (cf create-service-instance)
-	m.Put("/v2/service_instances/:id", CreateInstance)
-	// Last operation state used by async service instance creation
-	m.Get("/v2/service_instances/:id/last_operation", LastOperationInstance)
-
-	// Bind the service to app (cf bind-service)
-	m.Put("/v2/service_instances/:instance_id/service_bindings/:id", BindInstance)
-
-	// Unbind the service from app
-	m.Delete("/v2/service_instances/:instance_id/service_bindings/:id", func(p martini.Params, r render.Render) {
-		var emptyJson struct{}
-		r.JSON(200, emptyJson)
-	})
-
-	// Delete service instance
-	m.Delete("/v2/service_instances/:id", DeleteInstance)
+	m.Group("/v2", func(router martini.Router) {
+		// Serve the catalog with services and plans
+		router.Get("/catalog", func(r render.Render, catalog *Catalog) {
+			r.JSON(200, catalog)
+		})
+
+		// Create the service instance (cf create-service-instance)
+		router.Put("/service_instances/:id", InstanceLockHandler("id", AuditCreate), CreateInstance)
+		// Fetch the service instance
+		router.Get("/service_instances/:id", FetchInstance)
+		// Update the service instance plan (cf update-service)
+		router.Patch("/service_instances/:id", InstanceLockHandler("id", AuditUpdate), UpdateInstance)
+		// Last operation state used by async service instance creation, update and deletion
+		router.Get("/service_instances/:id/last_operation", LastOperationInstance)
+
+		// Bind the service to app (cf bind-service)
+		router.Put("/service_instances/:instance_id/service_bindings/:id", InstanceLockHandler("instance_id", AuditBind), BindInstance)
+
+		// Fetch the binding
+		router.Get("/service_instances/:instance_id/service_bindings/:id", FetchBinding)
+
+		// Unbind the service from app
+		router.Delete("/service_instances/:instance_id/service_bindings/:id", InstanceLockHandler("instance_id", AuditUnbind), UnbindInstance)
+
+		// Delete service instance
+		router.Delete("/service_instances/:id", InstanceLockHandler("id", AuditDelete), DeleteInstance)
+	}, auth.Basic(username, password), BrokerAPIVersionHandler(), OriginatingIdentityHandler())
+
+	if adminUsername == "" || adminPassword == "" {
+		log.Println("ADMIN_USER and ADMIN_PASS are not set, the admin API is disabled")
+		return m
+	}
+	m.Group("/admin", func(router martini.Router) {
+		// Who did what to the instances
+		router.Get("/audit_events", AuditEvents)
+
+		// Registry of the servers hosting the shared instances
+		router.Get("/shared_servers", SharedServers)
+		router.Post("/shared_servers", CreateSharedServer)
+		router.Patch("/shared_servers/:id", UpdateSharedServer)
+		router.Delete("/shared_servers/:id", DeleteSharedServer)
+	}, auth.Basic(adminUsername, adminPassword))
 
 	return m
 }
@@ -5,13 +5,17 @@ import (
 	"github.com/jinzhu/gorm"
 
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var createInstanceReq []byte = []byte(
@@ -22,11 +26,40 @@ var createInstanceReq []byte = []byte(
 	"space_guid":"a-space"
 }`)
 
+var createDedicatedInstanceReq []byte = []byte(
+	`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+	"organization_guid":"an-org",
+	"space_guid":"a-space"
+}`)
+
+var updateInstanceReq []byte = []byte(
+	`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"332e0168-6969-4bd7-b07f-29f08c4bf78e",
+	"previous_values": {
+		"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6"
+	}
+}`)
+
+var bindInstanceReq []byte = []byte(
+	`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"44d24fc7-f7a4-4ac1-b7a0-de82836e89a3",
+	"app_guid":"an-app"
+}`)
+
 var brokerDB *gorm.DB
 
+// brokerAPIVersion is the version of the broker API the tests speak.
+const brokerAPIVersion = "2.14"
+
 func setup() *martini.ClassicMartini {
 	os.Setenv("AUTH_USER", "default")
 	os.Setenv("AUTH_PASS", "default")
+	os.Setenv("ADMIN_USER", "admin")
+	os.Setenv("ADMIN_PASS", "admin")
 	var s Settings
 	var dbConfig DBConfig
 	s.DbConfig = &dbConfig
@@ -46,6 +79,10 @@ func setup() *martini.ClassicMartini {
 */
 
 func doRequest(m *martini.ClassicMartini, url string, method string, auth bool, body io.Reader) (*httptest.ResponseRecorder, *martini.ClassicMartini) {
+	return doRequestWithHeaders(m, url, method, auth, body, nil)
+}
+
+func doRequestWithHeaders(m *martini.ClassicMartini, url string, method string, auth bool, body io.Reader, headers map[string]string) (*httptest.ResponseRecorder, *martini.ClassicMartini) {
 	if m == nil {
 		m = setup()
 	}
@@ -55,12 +92,23 @@ func doRequest(m *martini.ClassicMartini, url string, method string, auth bool,
 	if auth {
 		req.SetBasicAuth("default", "default")
 	}
+	req.Header.Set(BrokerAPIVersionHeader, brokerAPIVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	m.ServeHTTP(res, req)
 
 	return res, m
 }
 
+// doAdminRequest sends a request to the admin API with the admin credentials.
+func doAdminRequest(m *martini.ClassicMartini, url string, method string, body io.Reader) (*httptest.ResponseRecorder, *martini.ClassicMartini) {
+	return doRequestWithHeaders(m, url, method, false, body, map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:admin")),
+	})
+}
+
 /*
 	End Mock Objects
 */
@@ -90,6 +138,42 @@ func TestCatalog(t *testing.T) {
 
 	// Is it a valid JSON?
 	validJson(res.Body.Bytes(), url, t)
+
+	// Does it publish the parameter schemas?
+	if !strings.Contains(string(res.Body.Bytes()), `"service_instance":{"create":{"parameters":`) {
+		t.Error(url, "should return the schemas of the plans")
+	}
+}
+
+func TestBrokerAPIVersion(t *testing.T) {
+	url := "/v2/catalog"
+	m := setup()
+
+	for _, version := range []string{"", "2.6", "1.20", "3.0", "two"} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.SetBasicAuth("default", "default")
+		if version != "" {
+			req.Header.Set(BrokerAPIVersionHeader, version)
+		}
+		m.ServeHTTP(res, req)
+
+		if res.Code != http.StatusPreconditionFailed {
+			t.Error(url, "with version", version, "should return 412 and it returned", res.Code)
+		}
+	}
+
+	for _, version := range []string{"2.7", "2.13", "2.99"} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.SetBasicAuth("default", "default")
+		req.Header.Set(BrokerAPIVersionHeader, version)
+		m.ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Error(url, "with version", version, "should return 200 and it returned", res.Code)
+		}
+	}
 }
 
 func TestCreateInstance(t *testing.T) {
@@ -98,7 +182,7 @@ func TestCreateInstance(t *testing.T) {
 	res, _ := doRequest(nil, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
 
 	if res.Code != http.StatusCreated {
-		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
 		t.Error(url, "with auth should return 201 and it returned", res.Code)
 	}
 
@@ -126,6 +210,451 @@ func TestCreateInstance(t *testing.T) {
 	}
 }
 
+func TestCreateSharedMySQLInstance(t *testing.T) {
+	url := "/v2/service_instances/the_mysql_instance"
+	req := strings.Replace(string(createInstanceReq), "44d24fc7-f7a4-4ac1-b7a0-de82836e89a3",
+		"3b67c4a4-9991-423c-a068-cfbebd0822d8", 1)
+
+	res, m := doRequest(nil, url, "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusCreated {
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "should return 201 and it returned", res.Code)
+	}
+
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_mysql_instance").First(&i)
+	if i.Adapter != AdapterShared || i.DbType != "mysql" {
+		t.Error("The instance should be a shared MySQL database")
+	}
+
+	req = strings.Replace(string(bindInstanceReq), "44d24fc7-f7a4-4ac1-b7a0-de82836e89a3",
+		"3b67c4a4-9991-423c-a068-cfbebd0822d8", 1)
+	res, _ = doRequest(m, url+"/service_bindings/the_mysql_binding", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusCreated {
+		t.Error(url, "binding should return 201 and it returned", res.Code)
+	}
+
+	if !strings.Contains(res.Body.String(), "mysql://") {
+		t.Error(url, "binding should return MySQL credentials")
+	}
+}
+
+func TestCreateInstanceWithParameters(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance?accepts_incomplete=true"
+	req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"storage_gb": 1}`, 1)
+
+	res, m := doRequest(nil, url, "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with invalid parameters should return 400 and it returned", res.Code)
+	}
+
+	if !strings.Contains(string(res.Body.Bytes()), "parameters.storage_gb") {
+		t.Error(url, "should describe the invalid parameter")
+	}
+
+	req = strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"storage_gb": 50, "multi_az": true}`, 1)
+
+	res, _ = doRequest(m, url, "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusAccepted {
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "with valid parameters should return 202 and it returned", res.Code)
+	}
+
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.DbStorage != 50 || !i.MultiAz {
+		t.Error("The instance should use the parameters")
+	}
+}
+
+func TestCreateInstanceFromSnapshot(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance"
+	req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"restore_from_snapshot": "not a snapshot"}`, 1)
+
+	res, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with an invalid snapshot should return 400 and it returned", res.Code)
+	}
+
+	req = strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"restore_from_snapshot": "a-snapshot"}`, 1)
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "with a snapshot should return 202 and it returned", res.Code)
+	}
+
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.SourceSnapshotId != "a-snapshot" || !i.RestorePending {
+		t.Error("The instance should be restored from the snapshot")
+	}
+
+	// The settings of the broker are applied once the restored instance is available.
+	res, _ = doRequest(m, url+"/last_operation", "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "last_operation should return 200 and it returned", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), string(InstanceCreationInProgress)) {
+		t.Error(url, "last_operation should be in progress while the restore is finished")
+	}
+
+	i = Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.RestorePending {
+		t.Error("The restore of the instance should be finished")
+	}
+}
+
+func TestCreateInstanceFromPointInTime(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance"
+	_, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	url = "/v2/service_instances/the_restored_instance?accepts_incomplete=true"
+	invalid := []string{
+		`{"source_instance_id": "the_dedicated_instance"}`,
+		`{"source_instance_id": "the_dedicated_instance", "restore_time": "yesterday"}`,
+		`{"source_instance_id": "an_unknown_instance", "restore_time": "2016-03-10T12:00:00Z"}`,
+	}
+	for _, parameters := range invalid {
+		req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+			`"space_guid":"a-space", "parameters": `+parameters, 1)
+		res, _ := doRequest(m, url, "PUT", true, strings.NewReader(req))
+		if res.Code != http.StatusBadRequest {
+			t.Error(url, "with", parameters, "should return 400 and it returned", res.Code)
+		}
+	}
+
+	// The source must belong to the organization of the instance.
+	req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"source_instance_id": "the_dedicated_instance", "restore_time": "2016-03-10T12:00:00Z"}`, 1)
+	res, _ := doRequest(m, url, "PUT", true, strings.NewReader(strings.Replace(req, "an-org", "another-org", 1)))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with the instance of another organization should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusAccepted {
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "with a source instance should return 202 and it returned", res.Code)
+	}
+
+	source, i := Instance{}, Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&source)
+	brokerDB.Where("uuid = ?", "the_restored_instance").First(&i)
+	if i.SourceDatabase != source.Database || !i.RestoreTime.Equal(time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)) || !i.RestorePending {
+		t.Error("The instance should be restored from the source instance")
+	}
+}
+
+func TestCloneInstance(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance"
+	_, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	url = "/v2/service_instances/the_clone?accepts_incomplete=true"
+	req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"clone_from": "the_dedicated_instance"}`, 1)
+	res, _ := doRequest(m, url, "PUT", true, strings.NewReader(strings.Replace(req, "an-org", "another-org", 1)))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with the instance of another organization should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusAccepted {
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "with a source instance should return 202 and it returned", res.Code)
+	}
+
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_clone").First(&i)
+	if !i.SnapshotPending {
+		t.Error("The clone should wait for the snapshot of its source")
+	}
+
+	// The clone is restored once the snapshot is taken, then gets the settings of the broker.
+	url = "/v2/service_instances/the_clone/last_operation"
+	for _, pending := range []bool{true, false} {
+		res, _ = doRequest(m, url, "GET", true, nil)
+		if !strings.Contains(res.Body.String(), string(InstanceCreationInProgress)) {
+			t.Error(url, "should be in progress and it returned", res.Body.String())
+		}
+		i = Instance{}
+		brokerDB.Where("uuid = ?", "the_clone").First(&i)
+		if i.SnapshotPending || i.RestorePending != pending {
+			t.Error("The clone should be restored and its restore pending should be", pending)
+		}
+	}
+
+	// A shared instance can only be cloned into a shared instance.
+	url = "/v2/service_instances/the_instance?accepts_incomplete=true"
+	doRequest(m, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
+	req = strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"clone_from": "the_instance"}`, 1)
+	res, _ = doRequest(m, "/v2/service_instances/another_clone?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with a shared source should return 400 and it returned", res.Code)
+	}
+
+	req = strings.Replace(string(createInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"clone_from": "the_instance"}`, 1)
+	res, _ = doRequest(m, "/v2/service_instances/the_shared_clone", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusCreated {
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "with a shared source should return 201 and it returned", res.Code)
+	}
+	source := Instance{}
+	brokerDB.Where("uuid = ?", "the_instance").First(&source)
+	i = Instance{}
+	brokerDB.Where("uuid = ?", "the_shared_clone").First(&i)
+	if i.SourceDatabase != source.Database {
+		t.Error("The shared clone should be a copy of its source")
+	}
+}
+
+func TestReadReplicas(t *testing.T) {
+	m := setup()
+	catalog := m.Injector.Get(reflect.TypeOf(&Catalog{})).Interface().(*Catalog)
+	// fetchPlan returns a copy of the plan, the one of the catalog is changed in place.
+	for k, plan := range catalog.Services[0].Plans {
+		if plan.Id == "da91e15c-98c9-46a9-b114-02b8d28062c6" {
+			catalog.Services[0].Plans[k].ReadReplicas = 2
+		}
+	}
+
+	url := "/v2/service_instances/the_dedicated_instance"
+	doRequest(m, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	// The replicas are created once the instance is available.
+	res, _ := doRequest(m, url+"/last_operation", "GET", true, nil)
+	if !strings.Contains(res.Body.String(), string(InstanceCreationSucceeded)) {
+		t.Error(url, "last_operation should succeed once the replicas are available and it returned", res.Body.String())
+	}
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if len(i.Replicas()) != 2 {
+		t.Error("The instance should have 2 read replicas and it has", i.Replicas())
+	}
+
+	req := strings.Replace(string(bindInstanceReq), "44d24fc7-f7a4-4ac1-b7a0-de82836e89a3", "da91e15c-98c9-46a9-b114-02b8d28062c6", 1)
+	res, _ = doRequest(m, url+"/service_bindings/the_binding", "PUT", true, strings.NewReader(req))
+	var r struct {
+		Credentials struct {
+			ReplicaUris []string `json:"replica_uris"`
+		}
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+	if len(r.Credentials.ReplicaUris) != 2 {
+		t.Error(url, "binding should return the URIs of the replicas and it returned", res.Body.String())
+	}
+}
+
+func TestFetchInstance(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance"
+	res, m := doRequest(nil, url, "GET", true, nil)
+
+	// Without the instance
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "with auth should return 404 and it returned", res.Code)
+	}
+
+	req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space", "parameters": {"storage_gb": 50}`, 1)
+	doRequest(m, url+"?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+
+	res, _ = doRequestWithHeaders(m, url, "GET", true, nil, map[string]string{BrokerAPIVersionHeader: "2.13"})
+	if res.Code != http.StatusPreconditionFailed {
+		t.Error(url, "before 2.14 should return 412 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+
+	var r struct {
+		ServiceId  string `json:"service_id"`
+		PlanId     string `json:"plan_id"`
+		Parameters map[string]interface{}
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+
+	if r.ServiceId != "db80ca29-2d1b-4fbc-aad3-d03c0bfa7593" || r.PlanId != "da91e15c-98c9-46a9-b114-02b8d28062c6" {
+		t.Error(url, "should return the service and plan of the instance")
+	}
+
+	if r.Parameters["storage_gb"] != float64(50) {
+		t.Error(url, "should return the parameters of the instance and it returned", r.Parameters)
+	}
+
+	if strings.Contains(res.Body.String(), "usage") {
+		t.Error(url, "should not return the usage of an instance never measured")
+	}
+
+	// The usage of the shared instances is measured by the quota checker.
+	url = "/v2/service_instances/the_instance"
+	doRequest(m, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
+	brokerDB.Model(Instance{}).Where("uuid = ?", "the_instance").Updates(map[string]interface{}{
+		"storage_used":        1 << 20,
+		"storage_measured_at": time.Now(),
+	})
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	var u struct {
+		Usage InstanceUsage
+	}
+	json.Unmarshal(res.Body.Bytes(), &u)
+	if u.Usage.StorageUsedBytes != 1<<20 || u.Usage.StorageQuotaBytes != 5<<30 {
+		t.Error(url, "should return the usage of the instance and it returned", res.Body.String())
+	}
+}
+
+func TestUpdateInstance(t *testing.T) {
+	url := "/v2/service_instances/the_instance"
+	res, m := doRequest(nil, url+"?accepts_incomplete=true", "PATCH", true, bytes.NewBuffer(updateInstanceReq))
+
+	// Without the instance
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "with auth should return 404 and it returned", res.Code)
+	}
+
+	// A shared instance cannot change plans
+	doRequest(m, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, bytes.NewBuffer(updateInstanceReq))
+	if res.Code != 422 {
+		t.Error(url, "updating a shared instance should return 422 and it returned", res.Code)
+	}
+
+	// A dedicated instance can
+	url = "/v2/service_instances/the_dedicated_instance"
+	doRequest(m, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	res, _ = doRequest(m, url, "PATCH", true, bytes.NewBuffer(updateInstanceReq))
+	if res.Code != 422 {
+		t.Error(url, "without accepts_incomplete should return 422 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, bytes.NewBuffer(updateInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Log("Unable to update instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 202 and it returned", res.Code)
+	}
+
+	// Is it a valid JSON?
+	validJson(res.Body.Bytes(), url, t)
+
+	// Is the new plan saved in the database?
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.PlanId != "332e0168-6969-4bd7-b07f-29f08c4bf78e" || i.DbStorage != 20 {
+		t.Error("The instance should be on the new plan")
+	}
+}
+
+func TestUpdateInstanceStorage(t *testing.T) {
+	url := "/v2/service_instances/the_growing_instance"
+	_, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	update := `{"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593","parameters":%s}`
+	res, _ := doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"storage_gb":50}`)))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "increasing the storage should return 202 and it returned", res.Code, res.Body.String())
+	}
+
+	// The instance can't be changed before the update is over.
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"storage_gb":60}`)))
+	if res.Code != 422 || !strings.Contains(res.Body.String(), "ConcurrencyError") {
+		t.Error(url, "during an update should return a ConcurrencyError and it returned", res.Code)
+	}
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "DELETE", true, nil)
+	if res.Code != 422 {
+		t.Error(url, "deleting during an update should return 422 and it returned", res.Code)
+	}
+	doRequest(m, url+"/last_operation", "GET", true, nil)
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"storage_gb":20}`)))
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "can only be increased") {
+		t.Error(url, "decreasing the storage should return 400 and it returned", res.Code, res.Body.String())
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"storage_type":"io1"}`)))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "the io1 storage without iops should return 400 and it returned", res.Code)
+	}
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"storage_type":"io1","iops":3000}`)))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "the io1 storage with iops should return 202 and it returned", res.Code, res.Body.String())
+	}
+	doRequest(m, url+"/last_operation", "GET", true, nil)
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"max_allocated_storage":40}`)))
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "at least the allocated storage") {
+		t.Error(url, "a storage limit below the storage should return 400 and it returned", res.Code, res.Body.String())
+	}
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(fmt.Sprintf(update, `{"max_allocated_storage":200}`)))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "enabling the storage autoscaling should return 202 and it returned", res.Code, res.Body.String())
+	}
+	doRequest(m, url+"/last_operation", "GET", true, nil)
+
+	// Moving to a plan with less storage keeps the storage of the instance.
+	doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, bytes.NewBuffer(updateInstanceReq))
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_growing_instance").First(&i)
+	if i.DbStorage != 50 || i.StorageType != "io1" || i.Iops != 3000 || i.MaxAllocatedStorage != 200 {
+		t.Error("The instance should have 50 GB of io1 storage with 3000 IOPS, up to 200 GB, and it has", i.DbStorage, i.StorageType, i.Iops, i.MaxAllocatedStorage)
+	}
+}
+
+func TestEngineParameters(t *testing.T) {
+	url := "/v2/service_instances/the_tuned_instance"
+	req := strings.Replace(string(createDedicatedInstanceReq), `"space_guid":"a-space"`,
+		`"space_guid":"a-space","parameters":{"engine_parameters":{"shared_buffers":"1024"}}`, 1)
+	res, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with a static engine parameter should return 400 and it returned", res.Code)
+	}
+
+	req = strings.Replace(req, "shared_buffers", "work_mem", 1)
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "with a tunable engine parameter should return 202 and it returned", res.Code, res.Body.String())
+	}
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_tuned_instance").First(&i)
+	if i.ParameterGroup != i.ParameterGroupName() {
+		t.Error("The instance should have its own parameter group and it has", i.ParameterGroup)
+	}
+
+	// The parameters can be changed without changing the plan.
+	update := `{"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593","parameters":{"engine_parameters":{"statement_timeout":"60000"}}}`
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(update))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "updating the engine parameters should return 202 and it returned", res.Code, res.Body.String())
+	}
+	doRequest(m, url+"/last_operation", "GET", true, nil)
+	i = Instance{}
+	brokerDB.Where("uuid = ?", "the_tuned_instance").First(&i)
+	expected := map[string]string{"work_mem": "1024", "statement_timeout": "60000"}
+	if got := i.GetEngineParameters(); !reflect.DeepEqual(got, expected) {
+		t.Error("The engine parameters should be", expected, "and they are", got)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PATCH", true, strings.NewReader(strings.Replace(update, "statement_timeout", "shared_buffers", 1)))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "updating a static engine parameter should return 400 and it returned", res.Code)
+	}
+
+	// The shared plans have no parameter group.
+	url = "/v2/service_instances/the_shared_instance"
+	doRequest(m, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
+	res, _ = doRequest(m, url, "PATCH", true, strings.NewReader(update))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "updating the engine parameters of a shared instance should return 400 and it returned", res.Code)
+	}
+}
+
 func TestBindInstance(t *testing.T) {
 	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
 	res, m := doRequest(nil, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
@@ -138,9 +667,9 @@ func TestBindInstance(t *testing.T) {
 	// Create the instance and try again
 	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, bytes.NewBuffer(createInstanceReq))
 
-	res, _ = doRequest(m, url, "PUT", true, nil)
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(bindInstanceReq))
 	if res.Code != http.StatusCreated {
-		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
 		t.Error(url, "with auth should return 201 and it returned", res.Code)
 	}
 
@@ -175,12 +704,92 @@ func TestBindInstance(t *testing.T) {
 	if instance.Password == r.Credentials.Password || r.Credentials.Password == "" {
 		t.Error(url, "should return an unencrypted password and it returned", r.Credentials.Password)
 	}
+
+	// Is the binding in the database with its own username?
+	binding := Binding{}
+	brokerDB.Where("uuid = ?", "the_binding").First(&binding)
+	if binding.Id == 0 {
+		t.Error("The binding should be saved in the DB")
+	}
+
+	if binding.Username != r.Credentials.Username || binding.Username == instance.Username {
+		t.Error(url, "should return the credentials of the binding and it returned", r.Credentials.Username)
+	}
+
+	if binding.AppGuid != "an-app" {
+		t.Error("The binding should have the app guid")
+	}
+
+	// Binding again with the same request returns the same credentials
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(bindInstanceReq))
+	if res.Code != http.StatusOK {
+		t.Error(url, "binding again should return 200 and it returned", res.Code)
+	}
+
+	var again response
+	json.Unmarshal(res.Body.Bytes(), &again)
+	if again.Credentials != r.Credentials {
+		t.Error(url, "binding again should return the same credentials")
+	}
+
+	// Binding again for another app conflicts
+	conflictReq := strings.Replace(string(bindInstanceReq), "an-app", "another-app", 1)
+	res, _ = doRequest(m, url, "PUT", true, strings.NewReader(conflictReq))
+	if res.Code != http.StatusConflict {
+		t.Error(url, "binding again for another app should return 409 and it returned", res.Code)
+	}
+
+	// The endpoint of a dedicated instance loaded by the binding is saved
+	doRequest(m, "/v2/service_instances/the_dedicated_instance?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+	url = "/v2/service_instances/the_dedicated_instance/service_bindings/the_dedicated_binding"
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(bindInstanceReq))
+	if res.Code != http.StatusCreated {
+		t.Error(url, "with auth should return 201 and it returned", res.Code)
+	}
+
+	instance = Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&instance)
+	if instance.Host == "" {
+		t.Error(url, "should save the endpoint of the instance")
+	}
+}
+
+func TestFetchBinding(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	res, m := doRequest(nil, url, "GET", true, nil)
+
+	// Without the binding
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "with auth should return 404 and it returned", res.Code)
+	}
+
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, bytes.NewBuffer(createInstanceReq))
+	bindRes, _ := doRequest(m, url, "PUT", true, bytes.NewBuffer(bindInstanceReq))
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+
+	if res.Body.String() != bindRes.Body.String() {
+		t.Error(url, "should return the credentials of the binding and it returned", res.Body.String())
+	}
 }
 
 func TestUnbind(t *testing.T) {
 	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
-	res, _ := doRequest(nil, url, "DELETE", true, nil)
+	res, m := doRequest(nil, url, "DELETE", true, nil)
+
+	// Without the binding
+	if res.Code != http.StatusGone {
+		t.Error(url, "with auth should return 410 and it returned", res.Code)
+	}
+
+	// Create the instance and the binding and try again
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, bytes.NewBuffer(createInstanceReq))
+	doRequest(m, url, "PUT", true, bytes.NewBuffer(bindInstanceReq))
 
+	res, _ = doRequest(m, url, "DELETE", true, nil)
 	if res.Code != http.StatusOK {
 		t.Error(url, "with auth should return 200 and it returned", res.Code)
 	}
@@ -192,6 +801,13 @@ func TestUnbind(t *testing.T) {
 	if string(res.Body.Bytes()) != "{}" {
 		t.Error(url, "should return an empty JSON")
 	}
+
+	// Is it actually gone from the DB?
+	binding := Binding{}
+	brokerDB.Where("uuid = ?", "the_binding").First(&binding)
+	if binding.Id > 0 {
+		t.Error("The binding shouldn't be in the DB")
+	}
 }
 
 func TestDeleteInstance(t *testing.T) {
@@ -214,7 +830,7 @@ func TestDeleteInstance(t *testing.T) {
 	res, _ = doRequest(m, url, "DELETE", true, nil)
 
 	if res.Code != http.StatusOK {
-		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
 		t.Error(url, "with auth should return 200 and it returned", res.Code)
 	}
 
@@ -225,3 +841,298 @@ func TestDeleteInstance(t *testing.T) {
 		t.Error("The instance shouldn't be in the DB")
 	}
 }
+
+func TestDeleteDedicatedInstance(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance"
+	_, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	res, _ := doRequest(m, url, "DELETE", true, nil)
+	if res.Code != 422 {
+		t.Error(url, "without accepts_incomplete should return 422 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true&final_snapshot=maybe", "DELETE", true, nil)
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with an invalid final_snapshot should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "DELETE", true, nil)
+	if res.Code != http.StatusAccepted {
+		t.Log("Unable to delete instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 202 and it returned", res.Code)
+	}
+
+	// Is it still in the DB while it is being deleted?
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.Id == 0 || i.State != InstanceDeleting {
+		t.Error("The instance should be in the DB and being deleted")
+	}
+
+	if i.FinalSnapshotId != "final-the-dedicated-instance" {
+		t.Error("A final snapshot of the instance should be taken, it is", i.FinalSnapshotId)
+	}
+
+	// Once the database is gone the last operation is gone too
+	res, _ = doRequest(m, url+"/last_operation", "GET", true, nil)
+	if res.Code != http.StatusGone {
+		t.Error(url, "last_operation should return 410 and it returned", res.Code)
+	}
+
+	i = Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.Id > 0 {
+		t.Error("The instance shouldn't be in the DB")
+	}
+
+	res, _ = doRequest(m, url+"/last_operation", "GET", true, nil)
+	if res.Code != http.StatusGone {
+		t.Error(url, "last_operation should keep returning 410 and it returned", res.Code)
+	}
+}
+
+func TestDeleteDedicatedInstanceWithoutFinalSnapshot(t *testing.T) {
+	url := "/v2/service_instances/the_dedicated_instance"
+	_, m := doRequest(nil, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+
+	res, _ := doRequest(m, url+"?accepts_incomplete=true&final_snapshot=false", "DELETE", true, nil)
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "should return 202 and it returned", res.Code)
+	}
+
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_dedicated_instance").First(&i)
+	if i.FinalSnapshotId != "" {
+		t.Error("No final snapshot of the instance should be taken")
+	}
+}
+
+func TestAuroraInstance(t *testing.T) {
+	url := "/v2/service_instances/the_aurora_instance"
+	req := strings.Replace(string(createDedicatedInstanceReq), "da91e15c-98c9-46a9-b114-02b8d28062c6", "0852d9ea-e2cf-4a62-abbb-9992b09fa9e9", 1)
+
+	res, m := doRequest(nil, url, "PUT", true, strings.NewReader(req))
+	if res.Code != 422 {
+		t.Error(url, "without accepts_incomplete should return 422 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, strings.NewReader(req))
+	if res.Code != http.StatusAccepted {
+		t.Log("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "should return 202 and it returned", res.Code)
+	}
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_aurora_instance").First(&i)
+	if i.Id == 0 || i.Adapter != AdapterAurora {
+		t.Error("The instance should be saved in the DB as an Aurora instance")
+	}
+
+	// The Aurora plans can't restore instances.
+	restoreReq := strings.Replace(req, `"space_guid":"a-space"`, `"space_guid":"a-space","parameters":{"restore_from_snapshot":"final-a"}`, 1)
+	res, _ = doRequest(m, "/v2/service_instances/the_restored_instance?accepts_incomplete=true", "PUT", true, strings.NewReader(restoreReq))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with restore_from_snapshot should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "DELETE", true, nil)
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "should be deleted asynchronously and it returned", res.Code)
+	}
+	i = Instance{}
+	brokerDB.Where("uuid = ?", "the_aurora_instance").First(&i)
+	if i.State != InstanceDeleting || i.FinalSnapshotId != "final-the-aurora-instance" {
+		t.Error("The instance should be deleted with a final snapshot and it is", i.State, i.FinalSnapshotId)
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	identity := map[string]string{
+		OriginatingIdentityHeader: "cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"a-user"}`)),
+	}
+
+	url := "/v2/service_instances/the_instance"
+	res, m := doRequestWithHeaders(nil, url, "PUT", true, bytes.NewBuffer(createInstanceReq), map[string]string{
+		OriginatingIdentityHeader: "cloudfoundry not-base64!",
+	})
+
+	// With an invalid identity
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with an invalid identity should return 400 and it returned", res.Code)
+	}
+
+	doRequestWithHeaders(m, url, "PUT", true, bytes.NewBuffer(createInstanceReq), identity)
+	doRequestWithHeaders(m, url+"/service_bindings/the_binding", "PUT", true, bytes.NewBuffer(bindInstanceReq), identity)
+	doRequestWithHeaders(m, url+"/service_bindings/the_binding", "DELETE", true, nil, identity)
+	doRequestWithHeaders(m, url, "DELETE", true, nil, identity)
+	doRequest(m, "/v2/service_instances/another_instance", "PUT", true, bytes.NewBuffer(createInstanceReq))
+
+	auditUrl := "/admin/audit_events?instance_uuid=the_instance&org_guid=an-org&since=2000-01-01T00:00:00Z"
+	res, _ = doRequest(m, auditUrl, "GET", false, nil)
+	if res.Code != http.StatusUnauthorized {
+		t.Error(auditUrl, "without auth should return 401 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, auditUrl, "GET", true, nil)
+	if res.Code != http.StatusUnauthorized {
+		t.Error(auditUrl, "with the broker credentials should return 401 and it returned", res.Code)
+	}
+
+	res, _ = doAdminRequest(m, auditUrl, "GET", nil)
+	if res.Code != http.StatusOK {
+		t.Error(auditUrl, "with auth should return 200 and it returned", res.Code)
+	}
+
+	var r struct {
+		Events []AuditEvent
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+
+	actions := []string{}
+	for _, event := range r.Events {
+		if event.User != "a-user" || event.Platform != "cloudfoundry" {
+			t.Error(auditUrl, "should return the user of the event and it returned", event.Platform, event.User)
+		}
+		actions = append(actions, event.Action)
+	}
+	if strings.Join(actions, ",") != "delete,unbind,bind,create" {
+		t.Error(auditUrl, "should return the events of the instance and it returned", actions)
+	}
+
+	// Filter on time
+	res, _ = doAdminRequest(m, "/admin/audit_events?until=2000-01-01T00:00:00Z", "GET", nil)
+	json.Unmarshal(res.Body.Bytes(), &r)
+	if len(r.Events) != 0 {
+		t.Error("There should be no events before 2000")
+	}
+
+	res, _ = doAdminRequest(m, "/admin/audit_events?since=yesterday", "GET", nil)
+	if res.Code != http.StatusBadRequest {
+		t.Error("An invalid time should return 400 and it returned", res.Code)
+	}
+}
+
+func TestSharedServers(t *testing.T) {
+	url := "/admin/shared_servers"
+	res, m := doAdminRequest(nil, url, "POST", strings.NewReader(`{"name": "pg1", "db_type": "oracle"}`))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with an invalid server should return 400 and it returned", res.Code)
+	}
+
+	server := `{"name": "pg1", "db_type": "postgres", "url": "pg1.example.com", "username": "admin", "password": "secret"}`
+	res, _ = doAdminRequest(m, url, "POST", strings.NewReader(server))
+	if res.Code != http.StatusCreated {
+		t.Error(url, "should return 201 and it returned", res.Code)
+	}
+	if strings.Contains(res.Body.String(), "secret") {
+		t.Error(url, "should not return the password")
+	}
+
+	res, _ = doAdminRequest(m, url, "POST", strings.NewReader(server))
+	if res.Code != http.StatusConflict {
+		t.Error(url, "with an existing name should return 409 and it returned", res.Code)
+	}
+
+	s := SharedServer{}
+	brokerDB.Where("name = ?", "pg1").First(&s)
+	if s.Port != 5432 || !s.Enabled {
+		t.Error("The server should be registered with the defaults")
+	}
+
+	// The shared instances are placed on the server.
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, bytes.NewBuffer(createInstanceReq))
+	i := Instance{}
+	brokerDB.Where("uuid = ?", "the_instance").First(&i)
+	if i.SharedServerId != s.Id {
+		t.Error("The instance should be placed on the shared server")
+	}
+
+	serverUrl := fmt.Sprintf("%s/%d", url, s.Id)
+	res, _ = doAdminRequest(m, serverUrl, "PATCH", strings.NewReader(`{"url": "pg2.example.com"}`))
+	if res.Code != http.StatusBadRequest {
+		t.Error(serverUrl, "changing the url should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doAdminRequest(m, serverUrl, "PATCH", strings.NewReader(`{"enabled": false, "tags": "ssd"}`))
+	if res.Code != http.StatusOK {
+		t.Error(serverUrl, "should return 200 and it returned", res.Code)
+	}
+	brokerDB.Where("id = ?", s.Id).First(&s)
+	if s.Enabled || s.Tags != "ssd" {
+		t.Error("The server should be updated")
+	}
+
+	// The connection opened with the previous password is closed once the password changes.
+	dbConfig, _ := s.DBConfig("12345678901234567890123456789012")
+	conn, _ := DBInit(&DBConfig{DbType: "sqlite3", DbName: ":memory:"})
+	sharedConnections.Lock()
+	sharedConnections.conns[sharedDBConnKey(dbConfig)] = conn
+	sharedConnections.Unlock()
+	res, _ = doAdminRequest(m, serverUrl, "PATCH", strings.NewReader(`{"password": "new secret"}`))
+	if res.Code != http.StatusOK {
+		t.Error(serverUrl, "changing the password should return 200 and it returned", res.Code)
+	}
+	sharedConnections.Lock()
+	_, cached := sharedConnections.conns[sharedDBConnKey(dbConfig)]
+	sharedConnections.Unlock()
+	if cached || conn.DB().Ping() == nil {
+		t.Error("The connection with the previous password should be closed")
+	}
+
+	res, _ = doAdminRequest(m, serverUrl, "DELETE", nil)
+	if res.Code != http.StatusConflict {
+		t.Error(serverUrl, "hosting instances should return 409 and it returned", res.Code)
+	}
+
+	doRequest(m, "/v2/service_instances/the_instance?service_id=db80ca29-2d1b-4fbc-aad3-d03c0bfa7593&plan_id=44d24fc7-f7a4-4ac1-b7a0-de82836e89a3", "DELETE", true, nil)
+	res, _ = doAdminRequest(m, serverUrl, "DELETE", nil)
+	if res.Code != http.StatusOK {
+		t.Error(serverUrl, "should return 200 and it returned", res.Code)
+	}
+
+	res, _ = doAdminRequest(m, url, "GET", nil)
+	if strings.Contains(res.Body.String(), "pg1") {
+		t.Error(url, "should not list the unregistered server")
+	}
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	url := "/v2/service_instances/the_instance"
+	_, m := doRequest(nil, url, "PUT", true, bytes.NewBuffer(createInstanceReq))
+
+	// Another broker is deleting the instance
+	lock := AcquireInstanceLock(brokerDB, "the_instance", AuditDelete)
+
+	res, _ := doRequest(m, url+"/service_bindings/the_binding", "PUT", true, bytes.NewBuffer(bindInstanceReq))
+	if res.Code != 422 || !strings.Contains(res.Body.String(), "ConcurrencyError") {
+		t.Error(url, "while another operation is in progress should return a ConcurrencyError and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != 422 {
+		t.Error(url, "while another operation is in progress should return 422 and it returned", res.Code)
+	}
+
+	ReleaseInstanceLock(brokerDB, lock)
+
+	res, _ = doRequest(m, url+"/service_bindings/the_binding", "PUT", true, bytes.NewBuffer(bindInstanceReq))
+	if res.Code != http.StatusCreated {
+		t.Error(url, "once the other operation is done should return 201 and it returned", res.Code)
+	}
+
+	// The lock is released after each request
+	left := InstanceLock{}
+	brokerDB.Where("instance_uuid = ?", "the_instance").First(&left)
+	if left.Id > 0 {
+		t.Error("The lock should be released")
+	}
+
+	// Nothing but the deletion can happen while an instance is being deleted
+	url = "/v2/service_instances/the_dedicated_instance"
+	doRequest(m, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(createDedicatedInstanceReq))
+	doRequest(m, url+"?accepts_incomplete=true", "DELETE", true, nil)
+
+	res, _ = doRequest(m, url+"/service_bindings/the_binding", "PUT", true, bytes.NewBuffer(bindInstanceReq))
+	if res.Code != 422 {
+		t.Error(url, "while the instance is being deleted should return 422 and it returned", res.Code)
+	}
+}
@@ -6,9 +6,13 @@ import (
 
 	"crypto/aes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -35,19 +39,122 @@ type Instance struct {
 
 	Host string `sql:"size(255)"`
 	Port int64
+	// ReaderHost is the reader endpoint of an Aurora cluster, which spreads the connections over its readers.
+	ReaderHost string `sql:"size(255)"`
+
+	// SharedServerId is the shared server hosting the database of a shared instance.
+	// Zero if it is hosted on the default server.
+	SharedServerId int64
 
 	DbType    string `sql:"size(255)"`
 	DbStorage int64
 	AwsRegion string
 	MultiAz   bool
 
+	// StorageType and Iops are the RDS storage type and provisioned IOPS of a dedicated instance.
+	// RDS picks the storage type when it is empty.
+	StorageType string `sql:"size(255)"`
+	Iops        int64
+	// MaxAllocatedStorage is the storage in GB up to which RDS grows the storage of a dedicated instance,
+	// no storage autoscaling if zero.
+	MaxAllocatedStorage int64
+
+	EngineVersion       string `sql:"size(255)"`
+	BackupRetentionDays int64
+
+	// PlanEngineVersion is the engine version of the plan the instance is moving to,
+	// the update upgrades the engine when it is newer than the running one.
+	PlanEngineVersion string `sql:"-"`
+
+	// Parameters holds the raw JSON parameters the instance was created with.
+	Parameters string `sql:"type:text"`
+
 	State DBInstanceState
 
+	// Storage usage of a shared instance, measured by the quota checker.
+	StorageUsed       int64
+	StorageMeasuredAt time.Time
+	// OverQuota tells if the database is blocked because it uses more than its storage.
+	OverQuota bool
+
+	// FinalSnapshotId is the snapshot RDS takes of a dedicated instance when it is deleted.
+	FinalSnapshotId string `sql:"size(255)"`
+
+	// SourceSnapshotId is the snapshot a dedicated instance was restored from.
+	SourceSnapshotId string `sql:"size(255)"`
+	// SourceInstanceId is the instance a dedicated instance was restored from, as it was at RestoreTime.
+	// RestoreTime is zero for the clones, which are copies of their source as it was when they were created.
+	SourceInstanceId string `sql:"size(255)"`
+	RestoreTime      time.Time
+	// SourceDatabase is the database, or the RDS identifier, of the source instance.
+	SourceDatabase string `sql:"size(255)"`
+	// SnapshotPending tells if the snapshot of the source of a dedicated clone is still being taken.
+	SnapshotPending bool
+	// RestorePending tells if the password and the settings of the broker still have to be applied
+	// to the restored instance.
+	RestorePending bool
+	// SetupPending tells if the database of a dedicated instance still has to be prepared for its bindings.
+	SetupPending bool
+
+	// ReplicaIds are the comma separated RDS identifiers of the read replicas of a dedicated instance,
+	// ReplicaHosts the comma separated hosts of the available ones.
+	ReplicaIds   string `sql:"type:text"`
+	ReplicaHosts string `sql:"type:text"`
+
+	// EngineParameters holds the JSON engine parameters of a dedicated instance,
+	// set in ParameterGroup, the parameter group the broker created for the instance.
+	EngineParameters string `sql:"type:text"`
+	ParameterGroup   string `sql:"size(255)"`
+	// PreviousParameterGroup is the parameter group a major upgrade replaced, deleted once the instance stopped using it.
+	PreviousParameterGroup string `sql:"size(255)"`
+
+	// DbName is the name of the database when it is not Database, as for the instances restored from a snapshot.
+	DbName string `sql:"size(255)"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt time.Time
 }
 
+// DatabaseName returns the name of the database of the instance.
+func (i *Instance) DatabaseName() string {
+	if i.DbName != "" {
+		return i.DbName
+	}
+	return i.Database
+}
+
+// Replicas returns the RDS identifiers of the read replicas of the instance.
+func (i *Instance) Replicas() []string {
+	return splitList(i.ReplicaIds)
+}
+
+// ReplicaURIs returns the URIs of the available read replicas of the instance, for the user and the password.
+func (i *Instance) ReplicaURIs(username, password string) []string {
+	var uris []string
+	for _, host := range splitList(i.ReplicaHosts) {
+		uris = append(uris, i.hostURI(host, username, password))
+	}
+	return uris
+}
+
+// hostURI returns the URI of the database of the instance on the host, for the user and the password.
+func (i *Instance) hostURI(host, username, password string) string {
+	scheme := "postgres"
+	if i.DbType == "mysql" || i.DbType == "mariadb" {
+		scheme = "mysql"
+	}
+	return fmt.Sprintf("%s://%s:%s@%s:%d/%s", scheme, username, password, host, i.Port, i.DatabaseName())
+}
+
+// splitList splits a comma separated list, the empty list has no items.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
 func (i *Instance) SetPassword(password, key string) error {
 	if i.Salt == "" {
 		return errors.New("Salt has to be set before writing the password")
@@ -81,27 +188,54 @@ func (i *Instance) GetPassword(key string) (string, error) {
 	return decrypted, nil
 }
 
-func (i *Instance) GetCredentials(password string) (map[string]string, error) {
-	var credentials map[string]string
+func (i *Instance) GetCredentials(username, password string) (map[string]interface{}, error) {
+	var uri, jdbcUrl string
 	switch i.DbType {
 	case "postgres":
-		uri := fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
-			i.Username,
+		uri = fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
+			username,
 			password,
 			i.Host,
 			i.Port,
-			i.Database)
-
-		credentials = map[string]string{
-			"uri":      uri,
-			"username": i.Username,
-			"password": password,
-			"host":     i.Host,
-			"db_name":  i.Database,
-		}
+			i.DatabaseName())
+		jdbcUrl = fmt.Sprintf("jdbc:postgresql://%s:%d/%s?user=%s&password=%s",
+			i.Host,
+			i.Port,
+			i.DatabaseName(),
+			username,
+			password)
+	case "mysql", "mariadb":
+		uri = fmt.Sprintf("mysql://%s:%s@%s:%d/%s",
+			username,
+			password,
+			i.Host,
+			i.Port,
+			i.DatabaseName())
+		jdbcUrl = fmt.Sprintf("jdbc:mysql://%s:%d/%s?user=%s&password=%s",
+			i.Host,
+			i.Port,
+			i.DatabaseName(),
+			username,
+			password)
 	default:
 		return nil, errors.New("Cannot generate credentials for unsupported db type: " + i.DbType)
 	}
+	credentials := map[string]interface{}{
+		"uri":      uri,
+		"jdbcUrl":  jdbcUrl, // The key the Java buildpack and Spring Cloud Connectors look for.
+		"username": username,
+		"password": password,
+		"host":     i.Host,
+		"port":     strconv.FormatInt(i.Port, 10),
+		"db_name":  i.DatabaseName(),
+	}
+	if uris := i.ReplicaURIs(username, password); len(uris) > 0 {
+		credentials["replica_uris"] = uris
+	}
+	if i.ReaderHost != "" {
+		credentials["reader_host"] = i.ReaderHost
+		credentials["reader_uri"] = i.hostURI(i.ReaderHost, username, password)
+	}
 	return credentials, nil
 }
 
@@ -137,8 +271,335 @@ func (i *Instance) Init(uuid string,
 	i.AwsRegion = os.Getenv("AWS_REGION")
 	i.DbStorage = plan.DbStorage
 	i.MultiAz = plan.MultiAz
+	i.EngineVersion = plan.EngineVersion
+	i.BackupRetentionDays = plan.BackupRetentionDays
+	i.StorageType = plan.StorageType
+	i.Iops = plan.Iops
+	i.MaxAllocatedStorage = plan.MaxAllocatedStorage
 	i.DbSubnetGroup = s.SubnetGroup
 	i.SecGroup = s.SecGroup
 
 	return nil
 }
+
+// OperationPending tells if the creation of a dedicated instance still has steps to go through once its database is available.
+func (i *Instance) OperationPending() bool {
+	return i.SnapshotPending || i.RestorePending || i.SetupPending
+}
+
+// OperationInProgress tells if an asynchronous operation on the instance is not over yet.
+// The instance can't be changed, bound or unbound before it is.
+func (i *Instance) OperationInProgress() bool {
+	return i.State == InstanceInProgress || i.State == InstanceDeleting || i.OperationPending()
+}
+
+// InstanceParameters are the parameters accepted when creating an instance.
+// They are validated against the schema of the plan before being applied.
+type InstanceParameters struct {
+	StorageGb           *int64            `json:"storage_gb"`
+	EngineVersion       string            `json:"engine_version"`
+	BackupRetentionDays *int64            `json:"backup_retention_days"`
+	MultiAz             *bool             `json:"multi_az"`
+	StorageType         string            `json:"storage_type"`
+	Iops                *int64            `json:"iops"`
+	MaxAllocatedStorage *int64            `json:"max_allocated_storage"`
+	RestoreFromSnapshot string            `json:"restore_from_snapshot"`
+	SourceInstanceId    string            `json:"source_instance_id"`
+	RestoreTime         string            `json:"restore_time"`
+	CloneFrom           string            `json:"clone_from"`
+	EngineParameters    map[string]string `json:"engine_parameters"`
+}
+
+// ApplyParameters overrides the values the instance got from its plan with the given raw JSON parameters.
+func (i *Instance) ApplyParameters(raw []byte) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+
+	var parameters InstanceParameters
+	if err := json.Unmarshal(raw, &parameters); err != nil {
+		return err
+	}
+
+	if parameters.StorageGb != nil {
+		i.DbStorage = *parameters.StorageGb
+	}
+	if parameters.EngineVersion != "" {
+		i.EngineVersion = parameters.EngineVersion
+	}
+	if parameters.BackupRetentionDays != nil {
+		i.BackupRetentionDays = *parameters.BackupRetentionDays
+	}
+	if parameters.MultiAz != nil {
+		i.MultiAz = *parameters.MultiAz
+	}
+	if err := i.applyStorage(parameters.StorageType, parameters.Iops); err != nil {
+		return err
+	}
+	if parameters.MaxAllocatedStorage != nil {
+		i.MaxAllocatedStorage = *parameters.MaxAllocatedStorage
+	}
+	if err := checkMaxAllocatedStorage(i.MaxAllocatedStorage, i.DbStorage, "max_allocated_storage"); err != nil {
+		return err
+	}
+	if parameters.RestoreFromSnapshot != "" {
+		i.SourceSnapshotId = parameters.RestoreFromSnapshot
+	}
+
+	// A point in time restore needs both the source instance and the time.
+	if (parameters.SourceInstanceId == "") != (parameters.RestoreTime == "") {
+		return errors.New("source_instance_id and restore_time must be given together")
+	}
+	if parameters.SourceInstanceId != "" {
+		if parameters.RestoreFromSnapshot != "" {
+			return errors.New("restore_from_snapshot and source_instance_id can't be given together")
+		}
+		restoreTime, err := time.Parse(time.RFC3339, parameters.RestoreTime)
+		if err != nil {
+			return errors.New("restore_time must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z")
+		}
+		i.SourceInstanceId = parameters.SourceInstanceId
+		i.RestoreTime = restoreTime.UTC()
+	}
+	if len(parameters.EngineParameters) > 0 {
+		if err := i.MergeEngineParameters(parameters.EngineParameters); err != nil {
+			return err
+		}
+	}
+	if parameters.CloneFrom != "" {
+		if parameters.RestoreFromSnapshot != "" || parameters.SourceInstanceId != "" {
+			return errors.New("clone_from can't be given with restore_from_snapshot or source_instance_id")
+		}
+		i.SourceInstanceId = parameters.CloneFrom
+	}
+	i.Parameters = string(raw)
+
+	return nil
+}
+
+// InstanceUpdateParameters are the parameters accepted when updating an instance.
+type InstanceUpdateParameters struct {
+	StorageGb           *int64            `json:"storage_gb"`
+	StorageType         string            `json:"storage_type"`
+	Iops                *int64            `json:"iops"`
+	MaxAllocatedStorage *int64            `json:"max_allocated_storage"`
+	EngineParameters    map[string]string `json:"engine_parameters"`
+}
+
+// ApplyUpdateParameters applies the given raw JSON parameters of an update to the instance.
+// It tells if the instance changed.
+func (i *Instance) ApplyUpdateParameters(raw []byte) (bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return false, nil
+	}
+
+	var parameters InstanceUpdateParameters
+	if err := json.Unmarshal(raw, &parameters); err != nil {
+		return false, err
+	}
+
+	changed := false
+	// RDS can't shrink the storage of an instance.
+	if parameters.StorageGb != nil && *parameters.StorageGb != i.DbStorage {
+		if *parameters.StorageGb < i.DbStorage {
+			return false, fmt.Errorf("storage_gb can only be increased, the instance has %d GB", i.DbStorage)
+		}
+		i.DbStorage = *parameters.StorageGb
+		changed = true
+	}
+	if parameters.StorageType != "" || parameters.Iops != nil {
+		if err := i.applyStorage(parameters.StorageType, parameters.Iops); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if parameters.MaxAllocatedStorage != nil && *parameters.MaxAllocatedStorage != i.MaxAllocatedStorage {
+		i.MaxAllocatedStorage = *parameters.MaxAllocatedStorage
+		changed = true
+	}
+	if err := checkMaxAllocatedStorage(i.MaxAllocatedStorage, i.DbStorage, "max_allocated_storage"); err != nil {
+		return false, err
+	}
+	if len(parameters.EngineParameters) > 0 {
+		if err := i.MergeEngineParameters(parameters.EngineParameters); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// applyStorage overrides the storage type and the provisioned IOPS of the instance with those given.
+// Changing the storage type to one without provisioned IOPS drops the IOPS of the instance.
+func (i *Instance) applyStorage(storageType string, iops *int64) error {
+	if storageType == "" && iops == nil {
+		return nil
+	}
+	if storageType != "" {
+		i.StorageType = storageType
+		if iops == nil && storageType != "io1" && storageType != "gp3" {
+			i.Iops = 0
+		}
+	}
+	if iops != nil {
+		i.Iops = *iops
+	}
+	return checkStorage(i.StorageType, i.Iops, "storage_type", "iops")
+}
+
+// snapshotInvalidChars are the characters RDS does not allow in snapshot identifiers.
+var snapshotInvalidChars = regexp.MustCompile("[^a-z0-9]+")
+
+// FinalSnapshotName returns the identifier of the final snapshot of the instance.
+// It is derived from the uuid of the instance only, so that the snapshot can be found from the uuid.
+func (i *Instance) FinalSnapshotName() string {
+	return i.snapshotName("final-")
+}
+
+// CloneSnapshotName returns the identifier of the snapshot of the source of a dedicated clone.
+func (i *Instance) CloneSnapshotName() string {
+	return i.snapshotName("clone-")
+}
+
+// snapshotName returns the prefix followed by the uuid of the instance.
+// RDS identifiers are letters, digits and single hyphens, starting with a letter.
+func (i *Instance) snapshotName(prefix string) string {
+	name := snapshotInvalidChars.ReplaceAllString(strings.ToLower(i.Uuid), "-")
+	return prefix + strings.Trim(name, "-")
+}
+
+// ChangePlan moves the instance to the given plan.
+// It only updates the fields of the instance, the adapter applies the change to the database.
+func (i *Instance) ChangePlan(plan *Plan) {
+	i.PlanId = plan.Id
+	// RDS can't shrink the storage, the instances keep the storage they got beyond the one of the plan.
+	if plan.DbStorage > i.DbStorage {
+		i.DbStorage = plan.DbStorage
+	}
+	i.MultiAz = plan.MultiAz
+	i.PlanEngineVersion = plan.EngineVersion
+	if plan.BackupRetentionDays > 0 {
+		i.BackupRetentionDays = plan.BackupRetentionDays
+	}
+	if plan.StorageType != "" {
+		i.StorageType = plan.StorageType
+		i.Iops = plan.Iops
+	}
+	// The storage autoscaling limit of the plan can't be below the storage the instance kept.
+	if plan.MaxAllocatedStorage != 0 {
+		i.MaxAllocatedStorage = plan.MaxAllocatedStorage
+		if i.MaxAllocatedStorage < i.DbStorage {
+			i.MaxAllocatedStorage = i.DbStorage
+		}
+	}
+}
+
+// Binding is a set of credentials handed out to a single application.
+// Every binding gets its own database role so that unbinding an application
+// revokes its access without touching the other bindings of the instance.
+type Binding struct {
+	Id           int64
+	Uuid         string `sql:"size(255)"`
+	InstanceUuid string `sql:"size(255)"`
+	AppGuid      string `sql:"size(255)"`
+	Username     string `sql:"size(255)"`
+	Password     string `sql:"size(255)"`
+	Salt         string `sql:"size(255)"`
+
+	ClearPassword string `sql:"-"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+func (b *Binding) SetPassword(password, key string) error {
+	if b.Salt == "" {
+		return errors.New("Salt has to be set before writing the password")
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(b.Salt)
+
+	encrypted, err := Encrypt(password, key, iv)
+	if err != nil {
+		return err
+	}
+
+	b.Password = encrypted
+	b.ClearPassword = password
+
+	return nil
+}
+
+func (b *Binding) GetPassword(key string) (string, error) {
+	if b.Salt == "" || b.Password == "" {
+		return "", errors.New("Salt and password has to be set before writing the password")
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(b.Salt)
+
+	decrypted, err := Decrypt(b.Password, key, iv)
+	if err != nil {
+		return "", err
+	}
+
+	return decrypted, nil
+}
+
+// GetCredentials returns the credentials of the binding to the instance.
+func (b *Binding) GetCredentials(i *Instance, key string) (map[string]interface{}, error) {
+	password, err := b.GetPassword(key)
+	if err != nil {
+		return nil, err
+	}
+	return i.GetCredentials(b.Username, password)
+}
+
+func (b *Binding) Init(uuid string, appGuid string, i *Instance, s *Settings) error {
+	b.Uuid = uuid
+	b.InstanceUuid = i.Uuid
+	b.AppGuid = appGuid
+
+	// Build random values
+	b.Username = "u" + randStr(15)
+	b.Salt = GenerateSalt(aes.BlockSize)
+	password := randStr(25)
+	if err := b.SetPassword(password, s.EncryptionKey); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const (
+	AuditCreate string = "create"
+	AuditUpdate string = "update"
+	AuditBind   string = "bind"
+	AuditUnbind string = "unbind"
+	AuditDelete string = "delete"
+)
+
+// AuditEvent records who performed an action on an instance.
+type AuditEvent struct {
+	Id           int64     `json:"id"`
+	Action       string    `sql:"size(255)" json:"action"`
+	InstanceUuid string    `sql:"size(255)" json:"instance_uuid"`
+	BindingUuid  string    `sql:"size(255)" json:"binding_uuid,omitempty"`
+	OrgGuid      string    `sql:"size(255)" json:"org_guid"`
+	SpaceGuid    string    `sql:"size(255)" json:"space_guid"`
+	Platform     string    `sql:"size(255)" json:"platform"`
+	User         string    `sql:"size(255)" json:"user"`
+	Identity     string    `sql:"type:text" json:"identity,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (e *AuditEvent) Init(action string, i *Instance, bindingUuid string, identity OriginatingIdentity) {
+	e.Action = action
+	e.InstanceUuid = i.Uuid
+	e.BindingUuid = bindingUuid
+	e.OrgGuid = i.OrgGuid
+	e.SpaceGuid = i.SpaceGuid
+	e.Platform = identity.Platform
+	e.User = identity.User()
+	e.Identity = identity.JSON()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tunableEngineParameters are the engine parameters the instances can set, by database type.
+// They are all dynamic, so that RDS applies them without rebooting the instances.
+var tunableEngineParameters = map[string][]string{
+	"postgres": {
+		"autovacuum_analyze_scale_factor",
+		"autovacuum_vacuum_scale_factor",
+		"default_statistics_target",
+		"effective_cache_size",
+		"idle_in_transaction_session_timeout",
+		"lock_timeout",
+		"log_min_duration_statement",
+		"log_statement",
+		"maintenance_work_mem",
+		"random_page_cost",
+		"statement_timeout",
+		"track_io_timing",
+		"work_mem",
+	},
+	"mysql": {
+		"group_concat_max_len",
+		"innodb_lock_wait_timeout",
+		"interactive_timeout",
+		"long_query_time",
+		"max_allowed_packet",
+		"max_connections",
+		"slow_query_log",
+		"sql_mode",
+		"wait_timeout",
+	},
+}
+
+func init() {
+	tunableEngineParameters["mariadb"] = tunableEngineParameters["mysql"]
+}
+
+// ParameterGroupAdapter is implemented by the adapters managing a parameter group per instance.
+type ParameterGroupAdapter interface {
+	// ApplyEngineParameters sets the engine parameters of the instance in its parameter group,
+	// which is created if the instance has none yet.
+	ApplyEngineParameters(i *Instance) error
+	// DeleteParameterGroup deletes the parameter group of a deleted instance.
+	DeleteParameterGroup(i *Instance) error
+}
+
+// GetEngineParameters returns the engine parameters the instance asked for.
+func (i *Instance) GetEngineParameters() map[string]string {
+	parameters := map[string]string{}
+	if i.EngineParameters != "" {
+		json.Unmarshal([]byte(i.EngineParameters), &parameters)
+	}
+	return parameters
+}
+
+// MergeEngineParameters adds the engine parameters to those of the instance, replacing their previous values.
+// Only the tunable parameters of the database type of the instance are accepted.
+func (i *Instance) MergeEngineParameters(parameters map[string]string) error {
+	tunable := tunableEngineParameters[i.DbType]
+	merged := i.GetEngineParameters()
+	for name, value := range parameters {
+		if !containsString(tunable, name) {
+			return errors.New("engine_parameters." + name + " is not supported, the supported parameters are " + strings.Join(tunable, ", "))
+		}
+		merged[name] = value
+	}
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	i.EngineParameters = string(encoded)
+	return nil
+}
+
+// ParameterGroupName returns the name of the parameter group the broker creates for the instance.
+func (i *Instance) ParameterGroupName() string {
+	return "broker-" + i.Database
+}
+
+// parameterGroup returns the parameter group of the instance, its own or the one of its plan.
+func (d *DedicatedDBAdapter) parameterGroup(i *Instance) string {
+	if i.ParameterGroup != "" {
+		return i.ParameterGroup
+	}
+	return d.Plan.ParameterGroup
+}
+
+// ApplyEngineParameters creates the parameter group of the instance, as a copy of the group of the plan
+// or with the defaults of the engine, and sets the engine parameters of the instance in it.
+// The group is attached to the instance by the creation or the next modification of the instance.
+func (d *DedicatedDBAdapter) ApplyEngineParameters(i *Instance) error {
+	parameters := i.GetEngineParameters()
+	if len(parameters) == 0 {
+		return nil
+	}
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+
+	if i.ParameterGroup == "" {
+		version, err := engineVersion(svc, i)
+		if err != nil {
+			return err
+		}
+		// The group exists when an update which failed afterwards is retried.
+		if err := d.createParameterGroup(svc, i, i.ParameterGroupName(), version); err != nil && !parameterGroupExists(err) {
+			return err
+		}
+		i.ParameterGroup = i.ParameterGroupName()
+	}
+	return setEngineParameters(svc, i.ParameterGroup, parameters)
+}
+
+// upgradeParameterGroup replaces the parameter group of the instance with a group of the family of the engine version
+// the instance is upgraded to, as RDS does not attach a group of another family. The new group is named after the major
+// version and gets the engine parameters of the instance. The previous group is deleted once the instance stopped using it.
+func (d *DedicatedDBAdapter) upgradeParameterGroup(svc *rds.RDS, i *Instance, version string) error {
+	major := majorEngineVersion(i.DbType, version)
+	name := i.ParameterGroupName() + "-" + parameterGroupInvalidChars.ReplaceAllString(strings.ToLower(major), "-")
+	if name == i.ParameterGroup {
+		return nil
+	}
+	// The group exists when an update which failed afterwards is retried.
+	if err := d.createParameterGroup(svc, i, name, version); err != nil && !parameterGroupExists(err) {
+		return err
+	}
+	if err := setEngineParameters(svc, name, i.GetEngineParameters()); err != nil {
+		return err
+	}
+
+	// A group left by a previous upgrade is no longer used once the instance is upgraded again.
+	if i.PreviousParameterGroup != "" {
+		if err := deleteParameterGroup(svc, i.PreviousParameterGroup); err != nil {
+			log.Println("Unable to delete the parameter group " + i.PreviousParameterGroup + ": " + err.Error())
+		}
+	}
+	i.PreviousParameterGroup = i.ParameterGroup
+	i.ParameterGroup = name
+	return nil
+}
+
+// deletePreviousParameterGroup deletes the parameter group replaced by an upgrade once the instance no longer uses it.
+// RDS refuses to delete it while it is attached, it is deleted on a next status check then.
+func (d *DedicatedDBAdapter) deletePreviousParameterGroup(i *Instance, databaseInstance *rds.DBInstance) {
+	if i.PreviousParameterGroup == "" {
+		return
+	}
+	for _, group := range databaseInstance.DBParameterGroups {
+		if group.DBParameterGroupName != nil && *group.DBParameterGroupName == i.PreviousParameterGroup {
+			return
+		}
+	}
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	if err := deleteParameterGroup(svc, i.PreviousParameterGroup); err != nil {
+		log.Println("Unable to delete the parameter group " + i.PreviousParameterGroup + ": " + err.Error())
+		return
+	}
+	i.PreviousParameterGroup = ""
+}
+
+// parameterGroupInvalidChars are the characters RDS does not allow in parameter group names.
+var parameterGroupInvalidChars = regexp.MustCompile("[^a-z0-9]+")
+
+// setEngineParameters sets the engine parameters in the parameter group.
+func setEngineParameters(svc *rds.RDS, group string, parameters map[string]string) error {
+	if len(parameters) == 0 {
+		return nil
+	}
+	// Sort the parameters so that the requests do not depend on the order of the map.
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rdsParameters []*rds.Parameter
+	for _, name := range names {
+		rdsParameters = append(rdsParameters, &rds.Parameter{
+			ParameterName:  aws.String(name),
+			ParameterValue: aws.String(parameters[name]),
+			ApplyMethod:    aws.String("immediate"),
+		})
+	}
+	_, err := svc.ModifyDBParameterGroup(&rds.ModifyDBParameterGroupInput{
+		DBParameterGroupName: &group,
+		Parameters:           rdsParameters,
+	})
+	return err
+}
+
+// createParameterGroup creates the parameter group of the instance with the name, as a copy of the group of the plan
+// or with the defaults of the engine version, the default version of the engine if it is empty.
+// The group of the plan is only copied if it belongs to the family of the engine version, as after a major upgrade
+// the instance can't use a copy of it.
+func (d *DedicatedDBAdapter) createParameterGroup(svc *rds.RDS, i *Instance, name, version string) error {
+	description := "Parameters of the instance " + i.Uuid
+	family, err := parameterGroupFamily(svc, i.DbType, version)
+	if err != nil {
+		return err
+	}
+	if d.Plan.ParameterGroup != "" {
+		planFamily, err := parameterGroupFamilyOf(svc, d.Plan.ParameterGroup)
+		if err != nil {
+			return err
+		}
+		if planFamily == family {
+			_, err := svc.CopyDBParameterGroup(&rds.CopyDBParameterGroupInput{
+				SourceDBParameterGroupIdentifier:  &d.Plan.ParameterGroup,
+				TargetDBParameterGroupIdentifier:  &name,
+				TargetDBParameterGroupDescription: &description,
+				Tags:                              instanceTags(i),
+			})
+			return err
+		}
+	}
+
+	_, err = svc.CreateDBParameterGroup(&rds.CreateDBParameterGroupInput{
+		DBParameterGroupName:   &name,
+		DBParameterGroupFamily: &family,
+		Description:            &description,
+		Tags:                   instanceTags(i),
+	})
+	return err
+}
+
+// engineVersion returns the engine version the instance runs if it exists, otherwise the one it is created with,
+// empty for the default version of the engine.
+func engineVersion(svc *rds.RDS, i *Instance) (string, error) {
+	resp, err := svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: &i.Database})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		return i.EngineVersion, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(resp.DBInstances) == 1 && resp.DBInstances[0].EngineVersion != nil {
+		return *resp.DBInstances[0].EngineVersion, nil
+	}
+	return i.EngineVersion, nil
+}
+
+// parameterGroupFamily returns the parameter group family of the engine version,
+// of the default version of the engine if the version is empty.
+func parameterGroupFamily(svc *rds.RDS, engine, version string) (string, error) {
+	params := &rds.DescribeDBEngineVersionsInput{Engine: &engine}
+	if version != "" {
+		params.EngineVersion = &version
+	} else {
+		params.DefaultOnly = aws.Boolean(true)
+	}
+	versions, err := svc.DescribeDBEngineVersions(params)
+	if err != nil {
+		return "", err
+	}
+	if len(versions.DBEngineVersions) == 0 || versions.DBEngineVersions[0].DBParameterGroupFamily == nil {
+		return "", errors.New("The parameter group family of " + engine + " " + version + " cannot be found")
+	}
+	return *versions.DBEngineVersions[0].DBParameterGroupFamily, nil
+}
+
+// parameterGroupFamilyOf returns the family of an existing parameter group.
+func parameterGroupFamilyOf(svc *rds.RDS, group string) (string, error) {
+	resp, err := svc.DescribeDBParameterGroups(&rds.DescribeDBParameterGroupsInput{DBParameterGroupName: &group})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.DBParameterGroups) == 0 || resp.DBParameterGroups[0].DBParameterGroupFamily == nil {
+		return "", errors.New("The parameter group family of " + group + " cannot be found")
+	}
+	return *resp.DBParameterGroups[0].DBParameterGroupFamily, nil
+}
+
+// DeleteParameterGroup deletes the parameter groups the broker created for the instance.
+func (d *DedicatedDBAdapter) DeleteParameterGroup(i *Instance) error {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	for _, group := range []string{i.PreviousParameterGroup, i.ParameterGroup} {
+		if group == "" {
+			continue
+		}
+		if err := deleteParameterGroup(svc, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parameterGroupExists tells if the parameter group could not be created because it already exists.
+func parameterGroupExists(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "DBParameterGroupAlreadyExists"
+}
+
+// deleteParameterGroup deletes a parameter group, a group already gone is skipped.
+func deleteParameterGroup(svc *rds.RDS, group string) error {
+	_, err := svc.DeleteDBParameterGroup(&rds.DeleteDBParameterGroupInput{
+		DBParameterGroupName: &group,
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBParameterGroupNotFound" {
+		return nil
+	}
+	return err
+}
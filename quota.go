@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"log"
+	"time"
+)
+
+// QuotaWarningRatio is the share of its storage an instance can use before a warning is logged.
+const QuotaWarningRatio = 0.9
+
+// DefaultQuotaCheckInterval is the time between two checks of the storage quotas.
+const DefaultQuotaCheckInterval = 10 * time.Minute
+
+// QuotaAdapter is implemented by the adapters which enforce the storage of the instances themselves.
+// The storage of the dedicated instances is allocated by RDS and needs no enforcement.
+type QuotaAdapter interface {
+	// GetDBSize returns the size of the database of the instance in bytes.
+	GetDBSize(i *Instance) (int64, error)
+	// SetDBBlocked blocks or restores the access to the database of the instance.
+	SetDBBlocked(i *Instance, blocked bool) error
+}
+
+// InstanceUsage is the storage usage of an instance, as returned when the instance is fetched.
+type InstanceUsage struct {
+	StorageUsedBytes  int64     `json:"storage_used_bytes"`
+	StorageQuotaBytes int64     `json:"storage_quota_bytes"`
+	OverQuota         bool      `json:"over_quota"`
+	MeasuredAt        time.Time `json:"measured_at"`
+}
+
+// StorageQuota returns the storage the instance can use in bytes.
+func (i *Instance) StorageQuota() int64 {
+	return i.DbStorage << 30
+}
+
+// Usage returns the last measured storage usage of the instance, nil if it was never measured.
+func (i *Instance) Usage() *InstanceUsage {
+	if i.StorageMeasuredAt.IsZero() {
+		return nil
+	}
+	return &InstanceUsage{
+		StorageUsedBytes:  i.StorageUsed,
+		StorageQuotaBytes: i.StorageQuota(),
+		OverQuota:         i.OverQuota,
+		MeasuredAt:        i.StorageMeasuredAt,
+	}
+}
+
+// StartQuotaChecker checks the storage quotas of the shared instances at every interval, in the background.
+func StartQuotaChecker(s *Settings, brokerDb *gorm.DB, catalog *Catalog, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			CheckQuotas(s, brokerDb, catalog)
+		}
+	}()
+}
+
+// CheckQuotas measures the storage of the shared instances, blocks the instances using more than
+// their storage and gives the access back to the ones using less than their storage again.
+// The instances get the storage of their plan when it was increased.
+func CheckQuotas(s *Settings, brokerDb *gorm.DB, catalog *Catalog) {
+	instances := []Instance{}
+	brokerDb.Where("adapter = ? AND state = ?", AdapterShared, InstanceReady).Find(&instances)
+
+	for k := range instances {
+		i := &instances[k]
+		plan := catalog.fetchPlan(i.ServiceId, i.PlanId)
+		if plan == nil {
+			continue
+		}
+		adapter, err := s.InitializeAdapter(plan, i, brokerDb)
+		if err != nil {
+			log.Println("Unable to check the quota of the instance " + i.Uuid + ": " + err.Error())
+			continue
+		}
+		quotaAdapter, ok := adapter.(QuotaAdapter)
+		if !ok {
+			continue
+		}
+		if plan.DbStorage > i.DbStorage {
+			i.DbStorage = plan.DbStorage
+		}
+
+		// Skip the instances being changed, they are checked next time.
+		lock := AcquireInstanceLock(brokerDb, i.Uuid, "quota")
+		if lock == nil {
+			continue
+		}
+		if err := checkQuota(brokerDb, i, quotaAdapter); err != nil {
+			log.Println("Unable to check the quota of the instance " + i.Uuid + ": " + err.Error())
+		}
+		ReleaseInstanceLock(brokerDb, lock)
+	}
+}
+
+// checkQuota measures the storage of the instance and enforces its quota.
+func checkQuota(brokerDb *gorm.DB, i *Instance, adapter QuotaAdapter) error {
+	size, err := adapter.GetDBSize(i)
+	if err != nil {
+		return err
+	}
+	i.StorageUsed = size
+	i.StorageMeasuredAt = time.Now()
+
+	quota := i.StorageQuota()
+	switch {
+	case size >= quota && !i.OverQuota:
+		if err := adapter.SetDBBlocked(i, true); err != nil {
+			return err
+		}
+		i.OverQuota = true
+		log.Printf("The instance %s uses %d bytes out of %d, it is now blocked", i.Uuid, size, quota)
+	case size < quota && i.OverQuota:
+		if err := adapter.SetDBBlocked(i, false); err != nil {
+			return err
+		}
+		i.OverQuota = false
+		log.Printf("The instance %s uses %d bytes out of %d, it is unblocked", i.Uuid, size, quota)
+	case size >= int64(float64(quota)*QuotaWarningRatio) && size < quota:
+		log.Printf("The instance %s uses %d bytes out of %d, it will be blocked once it is full", i.Uuid, size, quota)
+	}
+
+	return brokerDb.Save(i).Error
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// quotaAdapter is a QuotaAdapter with a database of a given size.
+type quotaAdapter struct {
+	size    int64
+	blocked bool
+	err     error
+}
+
+func (a *quotaAdapter) GetDBSize(i *Instance) (int64, error) {
+	return a.size, a.err
+}
+
+func (a *quotaAdapter) SetDBBlocked(i *Instance, blocked bool) error {
+	a.blocked = blocked
+	return nil
+}
+
+func TestCheckQuota(t *testing.T) {
+	setup()
+	i := Instance{Uuid: "the_instance", DbStorage: 1}
+	brokerDB.Create(&i)
+
+	if i.Usage() != nil {
+		t.Error("An instance never measured should have no usage")
+	}
+
+	adapter := &quotaAdapter{size: 900 << 20}
+	if err := checkQuota(brokerDB, &i, adapter); err != nil {
+		t.Fatal(err)
+	}
+	if adapter.blocked || i.OverQuota {
+		t.Error("An instance under its quota should stay accessible")
+	}
+
+	adapter.size = 2 << 30
+	checkQuota(brokerDB, &i, adapter)
+	if !adapter.blocked || !i.OverQuota {
+		t.Error("An instance over its quota should be blocked")
+	}
+
+	saved := Instance{}
+	brokerDB.Where("uuid = ?", "the_instance").First(&saved)
+	usage := saved.Usage()
+	if usage == nil || usage.StorageUsedBytes != 2<<30 || usage.StorageQuotaBytes != 1<<30 || !usage.OverQuota {
+		t.Error("The usage of the instance should be saved, it is", usage)
+	}
+
+	adapter.size = 100 << 20
+	checkQuota(brokerDB, &i, adapter)
+	if adapter.blocked || i.OverQuota {
+		t.Error("An instance back under its quota should be accessible again")
+	}
+
+	adapter.err = errors.New("no database")
+	if checkQuota(brokerDB, &i, adapter) == nil {
+		t.Error("A failed measure should fail the check")
+	}
+}
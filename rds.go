@@ -5,11 +5,15 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/awsutil"
 	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type DBInstanceState uint8
@@ -20,8 +24,13 @@ const (
 	InstanceReady                             // 2
 	InstanceGone                              // 3
 	InstanceNotGone                           // 4
+	InstanceNotUpdated                        // 5
+	InstanceDeleting                          // 6
 )
 
+// ErrInstanceNotFound is returned by GetDBStatus when the database does not exist (anymore).
+var ErrInstanceNotFound = errors.New("The database instance cannot be found")
+
 type InstanceCreationState string
 
 const (
@@ -35,10 +44,67 @@ type InstanceStatus struct {
 	Description string			`json:"description"`
 }
 
+// ErrSnapshotNotAllowed is returned when the snapshot to restore an instance from does not exist
+// or does not belong to the organization of the instance.
+var ErrSnapshotNotAllowed = errors.New("The snapshot cannot be found in the organization of the instance")
+
+// ErrSourceInstanceNotAllowed is returned when the instance to restore an instance from does not exist,
+// is not a dedicated instance of the same engine, or does not belong to the organization of the instance.
+var ErrSourceInstanceNotAllowed = errors.New("The source instance cannot be found in the organization of the instance")
+
+// ErrCloneNotSupported is returned when the source of a clone can't be copied by the adapter.
+var ErrCloneNotSupported = errors.New("The shared MySQL instances cannot be cloned")
+
+// RestoreWindowError is returned when the time to restore an instance at is out of the window
+// of its source instance.
+type RestoreWindowError struct {
+	Earliest time.Time
+	Latest   time.Time
+}
+
+func (e *RestoreWindowError) Error() string {
+	if e.Latest.IsZero() {
+		return "The source instance has no automated backups to restore from"
+	}
+	return "The restore time must be between " + e.Earliest.Format(time.RFC3339) + " and " + e.Latest.Format(time.RFC3339)
+}
+
+// RestoreAdapter is implemented by the adapters restoring instances from snapshots.
+type RestoreAdapter interface {
+	// FinishRestore applies the password and the settings of the broker to a restored instance once it is available.
+	FinishRestore(i *Instance, password string) error
+}
+
+// SetupAdapter is implemented by the adapters preparing the database of an instance once it is available.
+type SetupAdapter interface {
+	// SetupDB prepares the database of the instance for its bindings.
+	SetupDB(i *Instance, password string) error
+}
+
+// CloneAdapter is implemented by the adapters cloning instances in several steps.
+type CloneAdapter interface {
+	// RestoreClone creates the clone once the copy of its source is ready, it returns false until then.
+	RestoreClone(i *Instance) (bool, error)
+}
+
+// ReplicaAdapter is implemented by the adapters managing the read replicas of the instances.
+type ReplicaAdapter interface {
+	// SyncReplicas creates or deletes read replicas so that the instance has as many as its plan,
+	// and records the hosts of the available ones. It returns true while some are not available.
+	SyncReplicas(i *Instance) (bool, error)
+}
+
+// FinalSnapshotAdapter is implemented by the adapters taking a final snapshot of the instances they delete.
+type FinalSnapshotAdapter interface {
+	TagFinalSnapshot(i *Instance) error
+}
+
 type DBAdapter interface {
 	CreateDB(i *Instance, password string) (DBInstanceState, error)
+	UpdateDB(i *Instance) (DBInstanceState, error)
 	GetDBStatus(i *Instance) (InstanceStatus, error)
-	BindDBToApp(i *Instance, password string) (map[string]string, error)
+	BindDBToApp(i *Instance, password string, b *Binding) (map[string]interface{}, error)
+	UnbindDBFromApp(i *Instance, password string, b *Binding) error
 	DeleteDB(i *Instance) (DBInstanceState, error)
 }
 
@@ -47,25 +113,87 @@ type DBAdapter interface {
 // It is only here because *_test.go files are only compiled during "go test"
 // and it's referenced in non *_test.go code eg. InitializeAdapter in main.go.
 type MockDBAdapter struct {
+	ReadReplicas int64
 }
 
 func (d *MockDBAdapter) CreateDB(i *Instance, password string) (DBInstanceState, error) {
-	// TODO
+	if i.Adapter == AdapterDedicated && i.SourceDatabase != "" && i.RestoreTime.IsZero() {
+		i.SnapshotPending = true
+		return InstanceInProgress, nil
+	}
+	if i.Adapter == AdapterDedicated && (i.SourceSnapshotId != "" || i.SourceDatabase != "") {
+		i.RestorePending = true
+		return InstanceInProgress, nil
+	}
+	d.ApplyEngineParameters(i)
 	return InstanceReady, nil
 }
 
-func (d *MockDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
+func (d *MockDBAdapter) ApplyEngineParameters(i *Instance) error {
+	if len(i.GetEngineParameters()) > 0 {
+		i.ParameterGroup = i.ParameterGroupName()
+	}
+	return nil
+}
+
+func (d *MockDBAdapter) DeleteParameterGroup(i *Instance) error {
+	return nil
+}
+
+// SyncReplicas makes the replicas available right away.
+func (d *MockDBAdapter) SyncReplicas(i *Instance) (bool, error) {
+	var replicas, hosts []string
+	for n := int64(1); n <= d.ReadReplicas; n++ {
+		replicas = append(replicas, fmt.Sprintf("%s-replica-%d", i.Database, n))
+		hosts = append(hosts, fmt.Sprintf("replica-%d.example.com", n))
+	}
+	i.ReplicaIds = strings.Join(replicas, ",")
+	i.ReplicaHosts = strings.Join(hosts, ",")
+	return false, nil
+}
+
+func (d *MockDBAdapter) RestoreClone(i *Instance) (bool, error) {
+	i.SnapshotPending = false
+	i.RestorePending = true
+	return true, nil
+}
+
+func (d *MockDBAdapter) FinishRestore(i *Instance, password string) error {
+	return nil
+}
+
+func (d *MockDBAdapter) UpdateDB(i *Instance) (DBInstanceState, error) {
 	// TODO
-	return InstanceStatus{}, nil
+	return InstanceInProgress, nil
+}
+
+func (d *MockDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
+	// Deletions are done by the time they are polled.
+	if i.State == InstanceDeleting {
+		return InstanceStatus{}, ErrInstanceNotFound
+	}
+	// So are the creations.
+	return InstanceStatus{State: InstanceCreationSucceeded}, nil
+}
+
+func (d *MockDBAdapter) BindDBToApp(i *Instance, password string, b *Binding) (map[string]interface{}, error) {
+	// The endpoint is known once the instance is bound, as with the dedicated instances.
+	if i.Host == "" {
+		i.Host = i.Database + ".example.com"
+	}
+	return i.GetCredentials(b.Username, b.ClearPassword)
 }
 
-func (d *MockDBAdapter) BindDBToApp(i *Instance, password string) (map[string]string, error) {
+func (d *MockDBAdapter) UnbindDBFromApp(i *Instance, password string, b *Binding) error {
 	// TODO
-	return i.GetCredentials(password)
+	return nil
 }
 
 func (d *MockDBAdapter) DeleteDB(i *Instance) (DBInstanceState, error) {
-	// TODO
+	// Dedicated and Aurora instances are deleted asynchronously.
+	if i.Adapter != AdapterShared {
+		return InstanceInProgress, nil
+	}
 	return InstanceGone, nil
 }
 
@@ -73,81 +201,463 @@ func (d *MockDBAdapter) DeleteDB(i *Instance) (DBInstanceState, error) {
 
 type SharedDBAdapter struct {
 	SharedDbConn *gorm.DB
+	DbConfig     *DBConfig
+	Plan         *Plan
 }
 
 func (d *SharedDBAdapter) CreateDB(i *Instance, password string) (DBInstanceState, error) {
-	if db := d.SharedDbConn.Exec(fmt.Sprintf("CREATE DATABASE %s;", i.Database)); db.Error != nil {
-		return InstanceNotCreated, db.Error
+	var err error
+	if i.SourceDatabase != "" {
+		err = d.cloneDB(i)
+	} else {
+		err = execSQL(d.SharedDbConn, postgresCreateDatabase(i.Database))
+	}
+	if err != nil {
+		return InstanceNotCreated, err
+	}
+	if err := execSQL(d.SharedDbConn, postgresCreateUser(i.Username, password)); err != nil {
+		d.revertCreateDB(i, false)
+		return InstanceNotCreated, err
 	}
-	if db := d.SharedDbConn.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s';", i.Username, password)); db.Error != nil {
-		// TODO. Revert CREATE DATABASE.
-		return InstanceNotCreated, db.Error
+	if err := d.isolateDB(i); err != nil {
+		d.revertCreateDB(i, true)
+		return InstanceNotCreated, err
 	}
-	if db := d.SharedDbConn.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", i.Database, i.Username)); db.Error != nil {
-		// TODO. Revert CREATE DATABASE and CREATE USER.
-		return InstanceNotCreated, db.Error
+	if i.SourceDatabase != "" {
+		if err := d.takeOverClone(i); err != nil {
+			d.revertCreateDB(i, true)
+			return InstanceNotCreated, err
+		}
 	}
+	i.Host = d.DbConfig.Url
+	i.Port = d.DbConfig.Port
 	return InstanceReady, nil
 }
 
+// isolateDB restricts the database of the instance to the role of the instance and its bindings.
+// New databases can be connected to by every role and their public schema is writable by every role,
+// the role of the instance is made their owner and the privileges of PUBLIC are revoked.
+func (d *SharedDBAdapter) isolateDB(i *Instance) error {
+	statements := []string{
+		postgresGrantRoleToCurrentUser(i.Username),
+		postgresDatabaseOwner(i.Database, i.Username),
+		postgresRevokeDatabase(i.Database),
+	}
+	statements = append(statements, d.roleLimits(i.Username)...)
+	for _, statement := range statements {
+		if err := execSQL(d.SharedDbConn, statement); err != nil {
+			return err
+		}
+	}
+
+	// The schemas are changed from inside the database.
+	dbConfig := *d.DbConfig
+	dbConfig.DbName = i.Database
+	conn, err := DBInit(&dbConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := execSQL(conn, postgresSchemaOwner("public", i.Username)); err != nil {
+		return err
+	}
+	if err := execSQL(conn, postgresRevokeSchema("public")); err != nil {
+		return err
+	}
+
+	return verifyPostgresIsolation(d.SharedDbConn, conn, i)
+}
+
+// cloneDB creates the database of the instance as a copy of its SourceDatabase.
+// Postgres only copies a database nobody is connected to: the connections to the source are blocked
+// and its sessions are ended during the copy, its apps have to reconnect.
+func (d *SharedDBAdapter) cloneDB(i *Instance) error {
+	if err := execSQL(d.SharedDbConn, postgresDatabaseConnectionLimit(i.SourceDatabase, 0)); err != nil {
+		return err
+	}
+	defer func() {
+		if err := execSQL(d.SharedDbConn, postgresDatabaseConnectionLimit(i.SourceDatabase, -1)); err != nil {
+			log.Println("Unable to allow the connections to the database " + i.SourceDatabase + " again: " + err.Error())
+		}
+	}()
+	if err := terminatePostgresSessions(d.SharedDbConn, i.SourceDatabase); err != nil {
+		return err
+	}
+	return execSQL(d.SharedDbConn, postgresCreateDatabaseFrom(i.Database, i.SourceDatabase))
+}
+
+// takeOverClone hands the objects the copy got from the source database over to the role of the instance.
+// REASSIGN OWNED hands the source database over too, it is given back in the same transaction.
+func (d *SharedDBAdapter) takeOverClone(i *Instance) error {
+	var sourceOwner string
+	err := d.SharedDbConn.DB().QueryRow("SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = $1;", i.SourceDatabase).Scan(&sourceOwner)
+	if err != nil {
+		return err
+	}
+
+	dbConfig := *d.DbConfig
+	dbConfig.DbName = i.Database
+	conn, err := DBInit(&dbConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.DB().Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		postgresReassignOwned(sourceOwner, i.Username),
+		postgresDatabaseOwner(i.SourceDatabase, sourceOwner),
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// roleLimits returns the statements applying the limits of the plan to a role.
+func (d *SharedDBAdapter) roleLimits(role string) []string {
+	var statements []string
+	if d.Plan == nil {
+		return statements
+	}
+	if d.Plan.ConnectionLimit > 0 {
+		statements = append(statements, postgresConnectionLimit(role, d.Plan.ConnectionLimit))
+	}
+	if d.Plan.StatementTimeout != "" {
+		statements = append(statements, postgresRoleDefault(role, "statement_timeout", d.Plan.StatementTimeout))
+	}
+	if d.Plan.IdleInTransactionSessionTimeout != "" {
+		statements = append(statements, postgresRoleDefault(role, "idle_in_transaction_session_timeout", d.Plan.IdleInTransactionSessionTimeout))
+	}
+	return statements
+}
+
+// verifyPostgresIsolation checks that the database of the instance is owned by its role and that PUBLIC
+// can't connect to it, nor create anything in it.
+// conn is the connection to the server, dbConn the connection to the database of the instance.
+func verifyPostgresIsolation(conn *gorm.DB, dbConn *gorm.DB, i *Instance) error {
+	var owner string
+	var connect, create, temporary bool
+	err := conn.DB().QueryRow("SELECT pg_get_userbyid(datdba), has_database_privilege('public', datname, 'CONNECT'), "+
+		"has_database_privilege('public', datname, 'CREATE'), has_database_privilege('public', datname, 'TEMPORARY') "+
+		"FROM pg_database WHERE datname = $1;", i.Database).Scan(&owner, &connect, &create, &temporary)
+	if err != nil {
+		return err
+	}
+	if owner != i.Username {
+		return errors.New("The database of the instance is not owned by the instance")
+	}
+	if connect || create || temporary {
+		return errors.New("The database of the instance is not isolated from the other roles")
+	}
+
+	var schemaCreate bool
+	if err := dbConn.DB().QueryRow("SELECT has_schema_privilege('public', 'public', 'CREATE');").Scan(&schemaCreate); err != nil {
+		return err
+	}
+	if schemaCreate {
+		return errors.New("The public schema of the instance is writable by the other roles")
+	}
+	return nil
+}
+
+// revertCreateDB drops what a failed CreateDB created, so that no database or user is left behind.
+// The user is only dropped if it was created, a user with the same name may exist already.
+// Failures are logged, the error to report is the one of CreateDB.
+func (d *SharedDBAdapter) revertCreateDB(i *Instance, userCreated bool) {
+	if err := execSQL(d.SharedDbConn, postgresDropDatabase(i.Database)); err != nil {
+		log.Println("Unable to drop the database " + i.Database + " of a failed creation: " + err.Error())
+	}
+	if !userCreated {
+		return
+	}
+	if err := execSQL(d.SharedDbConn, postgresDropUser(i.Username)); err != nil {
+		log.Println("Unable to drop the user " + i.Username + " of a failed creation: " + err.Error())
+	}
+}
+
+func (d *SharedDBAdapter) UpdateDB(i *Instance) (DBInstanceState, error) {
+	return InstanceNotUpdated, errors.New("Shared instances cannot be updated")
+}
+
 func (d *SharedDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
-	rows, err := d.SharedDbConn.DB().Query(fmt.Sprintf("SELECT datname FROM pg_database WHERE datname='%s';", i.Database))
+	result := InstanceStatus{
+		State:       InstanceCreationFailed,
+		Description: "Unknown",
+	}
+	rows, err := d.SharedDbConn.DB().Query("SELECT datname FROM pg_database WHERE datname = $1;", i.Database)
+	if err != nil {
+		return result, err
+	}
 	defer rows.Close()
-	result := InstanceStatus{}
 	if rows.Next() {
 		result.State = InstanceCreationSucceeded
 		result.Description = "Creation completed"
-	} else {
-		result.State = InstanceCreationFailed
-		result.Description = "Unknown"
 	}
-	return result, err
+	return result, rows.Err()
+}
+
+func (d *SharedDBAdapter) BindDBToApp(i *Instance, password string, b *Binding) (map[string]interface{}, error) {
+	if err := createPostgresBindingRole(d.SharedDbConn, i.Username, b); err != nil {
+		return nil, err
+	}
+	// The bindings log in with their own role, the limits of the plan apply to them too.
+	statements := d.roleLimits(b.Username)
+	if i.OverQuota {
+		statements = append(statements, postgresRoleLogin(b.Username, false))
+	}
+	for _, statement := range statements {
+		if err := execSQL(d.SharedDbConn, statement); err != nil {
+			execSQL(d.SharedDbConn, postgresDropUser(b.Username))
+			return nil, err
+		}
+	}
+	return i.GetCredentials(b.Username, b.ClearPassword)
 }
 
-func (d *SharedDBAdapter) BindDBToApp(i *Instance, password string) (map[string]string, error) {
-	return i.GetCredentials(password)
+// UnbindDBFromApp drops the role of the binding, the objects it owns are handed over to the role of the instance.
+// They are handed over from inside the database of the instance.
+func (d *SharedDBAdapter) UnbindDBFromApp(i *Instance, password string, b *Binding) error {
+	dbConfig := *d.DbConfig
+	dbConfig.DbName = i.Database
+	conn, err := DBInit(&dbConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return dropPostgresBindingRole(d.SharedDbConn, conn, i.Username, b)
 }
 
+// DeleteDB drops the database and the user of the instance.
+// What is already gone is skipped, so that a deletion which failed halfway can be retried.
 func (d *SharedDBAdapter) DeleteDB(i *Instance) (DBInstanceState, error) {
-	if db := d.SharedDbConn.Exec(fmt.Sprintf("DROP DATABASE %s;", i.Database)); db.Error != nil {
-		return InstanceNotGone, db.Error
+	// The database can't be dropped while sessions are open on it.
+	if err := terminatePostgresSessions(d.SharedDbConn, i.Database); err != nil {
+		return InstanceNotGone, err
 	}
-	if db := d.SharedDbConn.Exec(fmt.Sprintf("DROP USER %s;", i.Username)); db.Error != nil {
-		return InstanceNotGone, db.Error
+	if err := execSQL(d.SharedDbConn, postgresDropDatabase(i.Database)); err != nil {
+		return InstanceNotGone, err
+	}
+	if err := execSQL(d.SharedDbConn, postgresDropUser(i.Username)); err != nil {
+		return InstanceNotGone, err
+	}
+	return InstanceGone, nil
+}
+
+func (d *SharedDBAdapter) GetDBSize(i *Instance) (int64, error) {
+	var size int64
+	err := d.SharedDbConn.DB().QueryRow("SELECT pg_database_size($1);", i.Database).Scan(&size)
+	return size, err
+}
+
+// SetDBBlocked stops the role of the instance and the roles of its bindings from logging in, or lets them log in again.
+// The roles own the objects of the database and could give themselves back any privilege taken from them,
+// but they can't give themselves back the login. The open sessions are ended when the roles are blocked.
+func (d *SharedDBAdapter) SetDBBlocked(i *Instance, blocked bool) error {
+	roles, err := postgresRoleMembers(d.SharedDbConn, i.Username)
+	if err != nil {
+		return err
+	}
+	for _, role := range append(roles, i.Username) {
+		if err := execSQL(d.SharedDbConn, postgresRoleLogin(role, !blocked)); err != nil {
+			return err
+		}
+	}
+	if !blocked {
+		return nil
+	}
+	return terminatePostgresSessions(d.SharedDbConn, i.Database)
+}
+
+// terminatePostgresSessions ends the sessions open on the database, but the one of the connection.
+func terminatePostgresSessions(conn *gorm.DB, database string) error {
+	_, err := conn.DB().Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid();", database)
+	return err
+}
+
+// SharedMySQLAdapter creates a database and its users on a shared MySQL server.
+type SharedMySQLAdapter struct {
+	SharedDbConn *gorm.DB
+	DbConfig     *DBConfig
+}
+
+func (d *SharedMySQLAdapter) CreateDB(i *Instance, password string) (DBInstanceState, error) {
+	if i.SourceDatabase != "" {
+		return InstanceNotCreated, ErrCloneNotSupported
+	}
+	if err := execSQL(d.SharedDbConn, mysqlCreateDatabase(i.Database)); err != nil {
+		return InstanceNotCreated, err
+	}
+	if err := execSQL(d.SharedDbConn, mysqlCreateUser(i.Username, password)); err != nil {
+		d.revertCreateDB(i, false)
+		return InstanceNotCreated, err
+	}
+	if err := execSQL(d.SharedDbConn, mysqlGrantDatabase(i.Database, i.Username)); err != nil {
+		d.revertCreateDB(i, true)
+		return InstanceNotCreated, err
+	}
+	i.Host = d.DbConfig.Url
+	i.Port = d.DbConfig.Port
+	return InstanceReady, nil
+}
+
+// revertCreateDB drops what a failed CreateDB created, like SharedDBAdapter.revertCreateDB.
+func (d *SharedMySQLAdapter) revertCreateDB(i *Instance, userCreated bool) {
+	if err := execSQL(d.SharedDbConn, mysqlDropDatabase(i.Database)); err != nil {
+		log.Println("Unable to drop the database " + i.Database + " of a failed creation: " + err.Error())
+	}
+	if !userCreated {
+		return
+	}
+	if err := execSQL(d.SharedDbConn, mysqlDropUser(i.Username)); err != nil && !isMySQLError(err, mysqlErrUnknownUser) {
+		log.Println("Unable to drop the user " + i.Username + " of a failed creation: " + err.Error())
+	}
+}
+
+func (d *SharedMySQLAdapter) UpdateDB(i *Instance) (DBInstanceState, error) {
+	return InstanceNotUpdated, errors.New("Shared instances cannot be updated")
+}
+
+func (d *SharedMySQLAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
+	result := InstanceStatus{
+		State:       InstanceCreationFailed,
+		Description: "Unknown",
+	}
+	rows, err := d.SharedDbConn.DB().Query("SELECT SCHEMA_NAME FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?;", i.Database)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		result.State = InstanceCreationSucceeded
+		result.Description = "Creation completed"
+	}
+	return result, rows.Err()
+}
+
+func (d *SharedMySQLAdapter) BindDBToApp(i *Instance, password string, b *Binding) (map[string]interface{}, error) {
+	if err := createMySQLBindingUser(d.SharedDbConn, i, b); err != nil {
+		return nil, err
+	}
+	return i.GetCredentials(b.Username, b.ClearPassword)
+}
+
+func (d *SharedMySQLAdapter) UnbindDBFromApp(i *Instance, password string, b *Binding) error {
+	return dropMySQLBindingUser(d.SharedDbConn, b, "KILL %d;")
+}
+
+// DeleteDB drops the database and the user of the instance, skipping what is already gone.
+func (d *SharedMySQLAdapter) DeleteDB(i *Instance) (DBInstanceState, error) {
+	if err := execSQL(d.SharedDbConn, mysqlDropDatabase(i.Database)); err != nil {
+		return InstanceNotGone, err
+	}
+	// The user is gone when DROP USER fails with mysqlErrUnknownUser.
+	if err := execSQL(d.SharedDbConn, mysqlDropUser(i.Username)); err != nil && !isMySQLError(err, mysqlErrUnknownUser) {
+		return InstanceNotGone, err
 	}
 	return InstanceGone, nil
 }
 
+// Storage autoscaling is newer than the vendored SDK. The inputs of CreateDBInstance and ModifyDBInstance
+// are the shapes of the SDK with MaxAllocatedStorage, and they are sent with rdsRequest.
+
+type createDBInstanceInput struct {
+	AllocatedStorage           *int64     `type:"integer" required:"true"`
+	AutoMinorVersionUpgrade    *bool      `type:"boolean"`
+	BackupRetentionPeriod      *int64     `type:"integer"`
+	DBInstanceClass            *string    `type:"string" required:"true"`
+	DBInstanceIdentifier       *string    `type:"string" required:"true"`
+	DBName                     *string    `type:"string"`
+	DBParameterGroupName       *string    `type:"string"`
+	DBSubnetGroupName          *string    `type:"string"`
+	Engine                     *string    `type:"string" required:"true"`
+	EngineVersion              *string    `type:"string"`
+	IOPS                       *int64     `locationName:"Iops" type:"integer"`
+	MasterUserPassword         *string    `type:"string" required:"true"`
+	MasterUsername             *string    `type:"string" required:"true"`
+	MaxAllocatedStorage        *int64     `type:"integer"`
+	MultiAZ                    *bool      `type:"boolean"`
+	Port                       *int64     `type:"integer"`
+	PreferredBackupWindow      *string    `type:"string"`
+	PreferredMaintenanceWindow *string    `type:"string"`
+	PubliclyAccessible         *bool      `type:"boolean"`
+	StorageEncrypted           *bool      `type:"boolean"`
+	StorageType                *string    `type:"string"`
+	Tags                       []*rds.Tag `locationNameList:"Tag" type:"list"`
+	VPCSecurityGroupIDs        []*string  `locationName:"VpcSecurityGroupIds" locationNameList:"VpcSecurityGroupId" type:"list"`
+}
+
+type modifyDBInstanceInput struct {
+	AllocatedStorage           *int64    `type:"integer"`
+	AllowMajorVersionUpgrade   *bool     `type:"boolean"`
+	ApplyImmediately           *bool     `type:"boolean"`
+	AutoMinorVersionUpgrade    *bool     `type:"boolean"`
+	BackupRetentionPeriod      *int64    `type:"integer"`
+	DBInstanceClass            *string   `type:"string"`
+	DBInstanceIdentifier       *string   `type:"string" required:"true"`
+	DBParameterGroupName       *string   `type:"string"`
+	EngineVersion              *string   `type:"string"`
+	IOPS                       *int64    `locationName:"Iops" type:"integer"`
+	MasterUserPassword         *string   `type:"string"`
+	MaxAllocatedStorage        *int64    `type:"integer"`
+	MultiAZ                    *bool     `type:"boolean"`
+	PreferredBackupWindow      *string   `type:"string"`
+	PreferredMaintenanceWindow *string   `type:"string"`
+	StorageType                *string   `type:"string"`
+	VPCSecurityGroupIDs        []*string `locationName:"VpcSecurityGroupIds" locationNameList:"VpcSecurityGroupId" type:"list"`
+}
+
+// rdsRequest sends the RDS action with the input and decodes its result into the output.
+func rdsRequest(svc *rds.RDS, action string, input, output interface{}) error {
+	op := &aws.Operation{Name: action, HTTPMethod: "POST", HTTPPath: "/"}
+	return aws.NewRequest(svc.Service, op, input, output).Send()
+}
+
 type DedicatedDBAdapter struct {
 	InstanceType string
+	AccountId    string
+	SecGroup     string
+	Plan         *Plan
 }
 
 func (d *DedicatedDBAdapter) CreateDB(i *Instance, password string) (DBInstanceState, error) {
 	svc := rds.New(&aws.Config{Region: i.AwsRegion})
 
-	var rdsTags []*rds.Tag
+	rdsTags := instanceTags(i)
+	// The owner role of the Postgres instances is created once the database is available.
+	i.SetupPending = i.DbType == "postgres"
 
-	for k, v := range i.Tags {
-		var tag rds.Tag
-		tag = rds.Tag{
-			Key:   aws.String(k),
-			Value: aws.String(v),
-		}
+	switch {
+	case i.SourceSnapshotId != "":
+		return d.restoreDB(svc, i, rdsTags)
+	case i.SourceDatabase != "" && i.RestoreTime.IsZero():
+		return d.cloneDB(svc, i, rdsTags)
+	case i.SourceDatabase != "":
+		return d.restoreDBToPointInTime(svc, i, rdsTags)
+	}
 
-		rdsTags = append(rdsTags, &tag)
+	// The parameter group of the instance is created first, it is deleted if the instance can't be created.
+	if err := d.ApplyEngineParameters(i); err != nil {
+		return InstanceNotCreated, err
 	}
 
 	// Standard parameters
-	params := &rds.CreateDBInstanceInput{
+	params := &createDBInstanceInput{
 		AllocatedStorage: &i.DbStorage,
 		// Instance class is defined by the plan
 		DBInstanceClass:         &d.InstanceType,
 		DBInstanceIdentifier:    &i.Database,
 		DBName:                  &i.Database,
-		Engine:                  aws.String("postgres"),
+		Engine:                  &i.DbType,
+		Port:                    aws.Long(DefaultPort(i.DbType)),
 		MasterUserPassword:      &password,
 		MasterUsername:          &i.Username,
-		AutoMinorVersionUpgrade: aws.Boolean(true),
+		AutoMinorVersionUpgrade: d.autoMinorVersionUpgrade(),
 		MultiAZ:                 aws.Boolean(i.MultiAz),
 		StorageEncrypted:        aws.Boolean(true),
 		Tags:                    rdsTags,
@@ -156,27 +666,200 @@ func (d *DedicatedDBAdapter) CreateDB(i *Instance, password string) (DBInstanceS
 		VPCSecurityGroupIDs:     []*string{&i.SecGroup},
 	}
 
+	// Optional parameters, AWS picks the defaults when they are not set.
+	if i.EngineVersion != "" {
+		params.EngineVersion = &i.EngineVersion
+	}
+	if i.BackupRetentionDays > 0 {
+		params.BackupRetentionPeriod = &i.BackupRetentionDays
+	}
+	if d.Plan.BackupWindow != "" {
+		params.PreferredBackupWindow = &d.Plan.BackupWindow
+	}
+	if d.Plan.MaintenanceWindow != "" {
+		params.PreferredMaintenanceWindow = &d.Plan.MaintenanceWindow
+	}
+	if i.StorageType != "" {
+		params.StorageType = &i.StorageType
+	}
+	if i.Iops > 0 {
+		params.IOPS = &i.Iops
+	}
+	if i.MaxAllocatedStorage > 0 {
+		params.MaxAllocatedStorage = &i.MaxAllocatedStorage
+	}
+	if group := d.parameterGroup(i); group != "" {
+		params.DBParameterGroupName = &group
+	}
+
 	if *params.DBInstanceClass == "db.t2.micro" {
 		params.StorageEncrypted = aws.Boolean(false)
 	}
 
-	resp, err := svc.CreateDBInstance(params)
+	resp := &rds.CreateDBInstanceOutput{}
+	err := rdsRequest(svc, "CreateDBInstance", params, resp)
 	// Pretty-print the response data.
 	log.Println(awsutil.StringValue(resp))
 	// Decide if AWS service call was successful
 	if yes := d.DidAwsCallSucceed(err); yes {
 		return InstanceInProgress, nil
 	} else {
+		if err := d.DeleteParameterGroup(i); err != nil {
+			log.Println("Unable to delete the parameter group " + i.ParameterGroup + " of a failed creation: " + err.Error())
+		}
 		return InstanceNotCreated, nil
 	}
 }
 
+func (d *DedicatedDBAdapter) UpdateDB(i *Instance) (DBInstanceState, error) {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	current, err := svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: &i.Database})
+	if err != nil {
+		return InstanceNotUpdated, err
+	}
+	var running *rds.DBInstance
+	if len(current.DBInstances) == 1 {
+		running = current.DBInstances[0]
+	}
+	// The storage autoscaling grows the storage beyond the storage of the instance, RDS can't shrink it.
+	if running != nil && running.AllocatedStorage != nil && *running.AllocatedStorage > i.DbStorage {
+		i.DbStorage = *running.AllocatedStorage
+	}
+
+	params := &modifyDBInstanceInput{
+		DBInstanceIdentifier: &i.Database,
+		// Instance class is defined by the plan
+		DBInstanceClass:  &d.InstanceType,
+		AllocatedStorage: &i.DbStorage,
+		MultiAZ:          aws.Boolean(i.MultiAz),
+		ApplyImmediately: aws.Boolean(true),
+	}
+	d.applyPlanSettings(i, params)
+
+	// The engine is only upgraded when the new plan asks for a newer version than the one the instance runs,
+	// RDS can't downgrade it.
+	if i.PlanEngineVersion != "" && running != nil && running.EngineVersion != nil {
+		version := *running.EngineVersion
+		if compareEngineVersions(i.PlanEngineVersion, version) > 0 {
+			params.EngineVersion = &i.PlanEngineVersion
+			major := majorEngineVersion(i.DbType, i.PlanEngineVersion) != majorEngineVersion(i.DbType, version)
+			params.AllowMajorVersionUpgrade = aws.Boolean(major)
+			i.EngineVersion = i.PlanEngineVersion
+			// The parameter group of the instance or of its plan belongs to the family of the previous major version.
+			if major && d.parameterGroup(i) != "" {
+				if err := d.upgradeParameterGroup(svc, i, i.PlanEngineVersion); err != nil {
+					return InstanceNotUpdated, err
+				}
+				params.DBParameterGroupName = &i.ParameterGroup
+			}
+		}
+	}
+
+	resp := &rds.ModifyDBInstanceOutput{}
+	err = rdsRequest(svc, "ModifyDBInstance", params, resp)
+	// Pretty-print the response data.
+	log.Println(awsutil.StringValue(resp))
+	// Decide if AWS service call was successful
+	if yes := d.DidAwsCallSucceed(err); !yes {
+		return InstanceNotUpdated, err
+	}
+
+	// The read replicas get the class of the plan too, SyncReplicas adds or removes replicas afterwards.
+	for _, replica := range i.Replicas() {
+		_, err := svc.ModifyDBInstance(&rds.ModifyDBInstanceInput{
+			DBInstanceIdentifier: aws.String(replica),
+			DBInstanceClass:      &d.InstanceType,
+			ApplyImmediately:     aws.Boolean(true),
+		})
+		if !d.DidAwsCallSucceed(err) {
+			return InstanceNotUpdated, err
+		}
+	}
+	return InstanceInProgress, nil
+}
+
+// compareEngineVersions compares two engine versions component by component,
+// it returns a negative number if a is older than b, 0 if they are the same and a positive number if a is newer.
+// A version with less components matches the versions it prefixes, 9.6 is the same as 9.6.22.
+func compareEngineVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for n := 0; n < len(as) && n < len(bs); n++ {
+		an, aErr := strconv.Atoi(as[n])
+		bn, bErr := strconv.Atoi(bs[n])
+		if aErr != nil || bErr != nil {
+			// The components which aren't numbers, like the ones of Aurora, are compared as text.
+			if as[n] < bs[n] {
+				return -1
+			} else if as[n] > bs[n] {
+				return 1
+			}
+			continue
+		}
+		if an != bn {
+			return an - bn
+		}
+	}
+	return 0
+}
+
+// majorEngineVersion returns the major version of an engine version:
+// the first component for Postgres 10 and later, the first two components otherwise.
+func majorEngineVersion(engine, version string) string {
+	components := strings.Split(version, ".")
+	if first, err := strconv.Atoi(components[0]); err == nil && engine == "postgres" && first >= 10 {
+		return components[0]
+	}
+	if len(components) > 2 {
+		components = components[:2]
+	}
+	return strings.Join(components, ".")
+}
+
+// applyPlanSettings sets the backup retention and the storage of the instance and the settings of the plan
+// which can change after the creation.
+func (d *DedicatedDBAdapter) applyPlanSettings(i *Instance, params *modifyDBInstanceInput) {
+	if i.BackupRetentionDays > 0 {
+		params.BackupRetentionPeriod = &i.BackupRetentionDays
+	}
+	if d.Plan.BackupWindow != "" {
+		params.PreferredBackupWindow = &d.Plan.BackupWindow
+	}
+	if d.Plan.MaintenanceWindow != "" {
+		params.PreferredMaintenanceWindow = &d.Plan.MaintenanceWindow
+	}
+	if i.StorageType != "" {
+		params.StorageType = &i.StorageType
+	}
+	if i.Iops > 0 {
+		params.IOPS = &i.Iops
+	}
+	if i.MaxAllocatedStorage > 0 {
+		params.MaxAllocatedStorage = &i.MaxAllocatedStorage
+	}
+	params.AutoMinorVersionUpgrade = d.autoMinorVersionUpgrade()
+	// RDS uses a new parameter group once the instance reboots, GetDBStatus reboots it.
+	if group := d.parameterGroup(i); group != "" {
+		params.DBParameterGroupName = &group
+	}
+}
+
+// autoMinorVersionUpgrade tells if RDS upgrades the minor versions of the engine, true unless the plan says otherwise.
+func (d *DedicatedDBAdapter) autoMinorVersionUpgrade() *bool {
+	if d.Plan.AutoMinorVersionUpgrade != nil {
+		return d.Plan.AutoMinorVersionUpgrade
+	}
+	return aws.Boolean(true)
+}
+
 func (d *DedicatedDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
 	svc := rds.New(&aws.Config{Region: i.AwsRegion})
 	request := &rds.DescribeDBInstancesInput{
 		DBInstanceIdentifier: &i.Database,
 	}
 	result, err := svc.DescribeDBInstances(request)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		return InstanceStatus{}, ErrInstanceNotFound
+	}
 	instanceCount := len(result.DBInstances)
 	status := InstanceStatus{
 		State: InstanceCreationInProgress,
@@ -186,10 +869,20 @@ func (d *DedicatedDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
 		databaseInstance := result.DBInstances[0]
 		status.Description = "AWS status: " + *(databaseInstance.DBInstanceStatus)
 		switch *(databaseInstance.DBInstanceStatus) {
-		case "failed", "incompatible-parameters":
+		case "failed", "incompatible-parameters", "incompatible-restore":
 			status.State = InstanceCreationFailed
 		case "available":
 			status.State = InstanceCreationSucceeded
+			// The password reset of a restored instance is applied while the instance is available.
+			if pending := databaseInstance.PendingModifiedValues; pending != nil && pending.MasterUserPassword != nil {
+				status.State = InstanceCreationInProgress
+				status.Description = "Resetting the master password"
+			} else if applying := d.applyParameterGroups(i, databaseInstance); applying != "" {
+				status.State = InstanceCreationInProgress
+				status.Description = applying
+			} else {
+				d.deletePreviousParameterGroup(i, databaseInstance)
+			}
 		default:
 			status.State = InstanceCreationInProgress
 		}
@@ -197,10 +890,55 @@ func (d *DedicatedDBAdapter) GetDBStatus(i *Instance) (InstanceStatus, error) {
 	return status, err
 }
 
-func (d *DedicatedDBAdapter) BindDBToApp(i *Instance, password string) (map[string]string, error) {
-	// First, we need to check if the instance is up and available before binding.
-	// Only search for details if the instance was not indicated as ready.
-	if i.State != InstanceReady {
+// applyParameterGroups reboots an available instance whose parameter group waits for a reboot,
+// as the groups attached by an update or a restore only apply once it reboots.
+// It describes what is left to apply, empty once the parameter groups are in sync.
+func (d *DedicatedDBAdapter) applyParameterGroups(i *Instance, databaseInstance *rds.DBInstance) string {
+	for _, group := range databaseInstance.DBParameterGroups {
+		if group.ParameterApplyStatus == nil || *group.ParameterApplyStatus == "in-sync" {
+			continue
+		}
+		name := ""
+		if group.DBParameterGroupName != nil {
+			name = *group.DBParameterGroupName
+		}
+		if *group.ParameterApplyStatus != "pending-reboot" {
+			return "Applying the parameter group " + name
+		}
+		svc := rds.New(&aws.Config{Region: i.AwsRegion})
+		_, err := svc.RebootDBInstance(&rds.RebootDBInstanceInput{DBInstanceIdentifier: &i.Database})
+		if !d.DidAwsCallSucceed(err) {
+			log.Println("Unable to reboot the instance " + i.Database + ": " + err.Error())
+		}
+		return "Rebooting the instance to apply the parameter group " + name
+	}
+	return ""
+}
+
+func (d *DedicatedDBAdapter) BindDBToApp(i *Instance, password string, b *Binding) (map[string]interface{}, error) {
+	if i.RestorePending {
+		return nil, errors.New("The instance is being restored. Please wait and try again..")
+	}
+	if err := d.loadEndpoint(i); err != nil {
+		return nil, err
+	}
+	// If we get here that means the instance is up and we have the information for it.
+	conn, err := connectMaster(i, password)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := createMasterBindingUser(conn, i, b); err != nil {
+		return nil, err
+	}
+	return i.GetCredentials(b.Username, b.ClearPassword)
+}
+
+// loadEndpoint records the host and the port of the instance once it is available.
+func (d *DedicatedDBAdapter) loadEndpoint(i *Instance) error {
+	// First, we need to check if the instance is up and available before connecting to it.
+	// Only search for details if the instance was not indicated as ready with its endpoint.
+	if i.State != InstanceReady || i.Host == "" {
 		svc := rds.New(&aws.Config{Region: i.AwsRegion})
 		params := &rds.DescribeDBInstancesInput{
 			DBInstanceIdentifier: aws.String(i.Database),
@@ -221,7 +959,7 @@ func (d *DedicatedDBAdapter) BindDBToApp(i *Instance, password string) (map[stri
 				// error which satisfies the awserr.Error interface.
 				fmt.Println(err.Error())
 			}
-			return nil, err
+			return err
 		}
 
 		// Pretty-print the response data.
@@ -242,40 +980,492 @@ func (d *DedicatedDBAdapter) BindDBToApp(i *Instance, password string) (map[stri
 						break
 					} else {
 						// Something went horribly wrong. Should never get here.
-						return nil, errors.New("Inavlid memory for endpoint and/or endpoint members.")
+						return errors.New("Inavlid memory for endpoint and/or endpoint members.")
 					}
 				} else {
 					// Instance not up yet.
-					return nil, errors.New("Instance not available yet. Please wait and try again..")
+					return errors.New("Instance not available yet. Please wait and try again..")
 				}
 			}
 		} else {
 			// Couldn't find any instances.
-			return nil, errors.New("Couldn't find any instances.")
+			return errors.New("Couldn't find any instances.")
 		}
 	}
-	// If we get here that means the instance is up and we have the information for it.
-	return i.GetCredentials(password)
+	return nil
+}
+
+// SetupDB creates the owner role of a Postgres instance.
+func (d *DedicatedDBAdapter) SetupDB(i *Instance, password string) error {
+	if i.DbType != "postgres" {
+		return nil
+	}
+	if err := d.loadEndpoint(i); err != nil {
+		return err
+	}
+	conn, err := connectMaster(i, password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return preparePostgresOwnerRole(conn, i.Username)
+}
+
+func (d *DedicatedDBAdapter) UnbindDBFromApp(i *Instance, password string, b *Binding) error {
+	if err := d.loadEndpoint(i); err != nil {
+		return err
+	}
+	conn, err := connectMaster(i, password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return dropMasterBindingUser(conn, i, b)
+}
+
+// createMasterBindingUser creates the user of the binding, conn is connected as the master user of the instance.
+func createMasterBindingUser(conn *gorm.DB, i *Instance, b *Binding) error {
+	switch i.DbType {
+	case "mysql", "mariadb":
+		return createMySQLBindingUser(conn, i, b)
+	default:
+		// The instances created before the owner role get it on their next binding.
+		if err := preparePostgresOwnerRole(conn, i.Username); err != nil {
+			return err
+		}
+		return createPostgresBindingRole(conn, postgresOwnerRole, b)
+	}
+}
+
+// dropMasterBindingUser drops the user of the binding, conn is connected as the master user of the instance.
+func dropMasterBindingUser(conn *gorm.DB, i *Instance, b *Binding) error {
+	switch i.DbType {
+	case "mysql", "mariadb":
+		// RDS does not let the master user KILL the sessions of other users.
+		return dropMySQLBindingUser(conn, b, "CALL mysql.rds_kill(%d);")
+	default:
+		return dropPostgresBindingRole(conn, conn, postgresOwnerRole, b)
+	}
+}
+
+// connectMaster opens a connection to the database of the instance as its master user.
+func connectMaster(i *Instance, password string) (*gorm.DB, error) {
+	return DBInit(&DBConfig{
+		DbType:   i.DbType,
+		Url:      i.Host,
+		Username: i.Username,
+		Password: password,
+		DbName:   i.DatabaseName(),
+		Sslmode:  "require",
+		Port:     i.Port,
+	})
 }
 
 func (d *DedicatedDBAdapter) DeleteDB(i *Instance) (DBInstanceState, error) {
 	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+
+	// RDS promotes the replicas of a deleted instance to standalone instances, they are deleted first.
+	for _, replica := range i.Replicas() {
+		if err := d.deleteReplica(svc, replica); err != nil {
+			return InstanceNotGone, err
+		}
+	}
+
 	params := &rds.DeleteDBInstanceInput{
 		DBInstanceIdentifier: aws.String(i.Database), // Required
-		// FinalDBSnapshotIdentifier: aws.String("String"),
-		SkipFinalSnapshot: aws.Boolean(true),
+		SkipFinalSnapshot:    aws.Boolean(i.FinalSnapshotId == ""),
+	}
+	if i.FinalSnapshotId != "" {
+		params.FinalDBSnapshotIdentifier = aws.String(i.FinalSnapshotId)
 	}
 	resp, err := svc.DeleteDBInstance(params)
+	// The database is already gone, e.g. its creation failed, so is the instance.
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		if err := d.DeleteParameterGroup(i); err != nil {
+			log.Println("Unable to delete the parameter group " + i.ParameterGroup + ": " + err.Error())
+		}
+		return InstanceGone, nil
+	}
 	// Pretty-print the response data.
 	fmt.Println(awsutil.StringValue(resp))
 	// Decide if AWS service call was successful
+	// RDS takes a while to delete the instance, it is tracked with GetDBStatus.
 	if yes := d.DidAwsCallSucceed(err); yes {
-		return InstanceGone, nil
+		return InstanceInProgress, nil
 	} else {
-		return InstanceNotGone, nil
+		return InstanceNotGone, err
 	}
 }
 
+// SyncReplicas creates the missing read replicas of the instance and deletes the extra ones.
+// The replicas are named after the instance and numbered from 1, the last ones are deleted first.
+func (d *DedicatedDBAdapter) SyncReplicas(i *Instance) (bool, error) {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	replicas := i.Replicas()
+	defer func() { i.ReplicaIds = strings.Join(replicas, ",") }()
+
+	for int64(len(replicas)) < d.Plan.ReadReplicas {
+		replica := fmt.Sprintf("%s-replica-%d", i.Database, len(replicas)+1)
+		resp, err := svc.CreateDBInstanceReadReplica(&rds.CreateDBInstanceReadReplicaInput{
+			DBInstanceIdentifier:       aws.String(replica),
+			SourceDBInstanceIdentifier: &i.Database,
+			DBInstanceClass:            &d.InstanceType,
+			AutoMinorVersionUpgrade:    d.autoMinorVersionUpgrade(),
+			PubliclyAccessible:         aws.Boolean(false),
+			Tags:                       instanceTags(i),
+		})
+		log.Println(awsutil.StringValue(resp))
+		if !d.DidAwsCallSucceed(err) {
+			return false, err
+		}
+		replicas = append(replicas, replica)
+	}
+	for int64(len(replicas)) > d.Plan.ReadReplicas {
+		if err := d.deleteReplica(svc, replicas[len(replicas)-1]); err != nil {
+			return false, err
+		}
+		replicas = replicas[:len(replicas)-1]
+	}
+
+	var hosts []string
+	pending := false
+	for _, replica := range replicas {
+		resp, err := svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+			DBInstanceIdentifier: aws.String(replica),
+		})
+		if err != nil {
+			return false, err
+		}
+		if len(resp.DBInstances) != 1 {
+			return false, errors.New("The read replica " + replica + " cannot be found")
+		}
+		replicaInstance := resp.DBInstances[0]
+		if replicaInstance.DBInstanceStatus == nil || *replicaInstance.DBInstanceStatus != "available" || replicaInstance.Endpoint == nil {
+			pending = true
+			continue
+		}
+		hosts = append(hosts, *replicaInstance.Endpoint.Address)
+	}
+	i.ReplicaHosts = strings.Join(hosts, ",")
+	return pending, nil
+}
+
+// deleteReplica deletes a read replica, replicas have no final snapshot.
+// A replica already gone is skipped.
+func (d *DedicatedDBAdapter) deleteReplica(svc *rds.RDS, replica string) error {
+	resp, err := svc.DeleteDBInstance(&rds.DeleteDBInstanceInput{
+		DBInstanceIdentifier: aws.String(replica),
+		SkipFinalSnapshot:    aws.Boolean(true),
+	})
+	log.Println(awsutil.StringValue(resp))
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		return nil
+	}
+	if !d.DidAwsCallSucceed(err) {
+		return err
+	}
+	return nil
+}
+
+// restoreDB creates the instance from the snapshot of its SourceSnapshotId, which has to belong to the organization of the instance.
+// The data, the master user and the engine version come from the snapshot. The class and the subnet group come from the plan,
+// the password and the security group are applied by FinishRestore once the instance is available.
+func (d *DedicatedDBAdapter) restoreDB(svc *rds.RDS, i *Instance, tags []*rds.Tag) (DBInstanceState, error) {
+	snapshot, err := d.orgSnapshot(svc, i)
+	if err != nil {
+		return InstanceNotCreated, err
+	}
+	return d.restoreFromSnapshot(svc, i, snapshot, tags)
+}
+
+// restoreFromSnapshot creates the instance from the snapshot.
+func (d *DedicatedDBAdapter) restoreFromSnapshot(svc *rds.RDS, i *Instance, snapshot *rds.DBSnapshot, tags []*rds.Tag) (DBInstanceState, error) {
+	if snapshot.Engine == nil || *snapshot.Engine != i.DbType {
+		return InstanceNotCreated, errors.New("The snapshot is not a " + i.DbType + " database")
+	}
+	if snapshot.Status == nil || *snapshot.Status != "available" {
+		return InstanceNotCreated, errors.New("The snapshot is not available yet")
+	}
+
+	i.Username = *snapshot.MasterUsername
+	if snapshot.EngineVersion != nil {
+		i.EngineVersion = *snapshot.EngineVersion
+	}
+	// The storage can't be smaller than the one of the snapshot.
+	if snapshot.AllocatedStorage != nil && *snapshot.AllocatedStorage > i.DbStorage {
+		i.DbStorage = *snapshot.AllocatedStorage
+	}
+
+	params := &rds.RestoreDBInstanceFromDBSnapshotInput{
+		DBInstanceIdentifier:    &i.Database,
+		DBSnapshotIdentifier:    &i.SourceSnapshotId,
+		DBInstanceClass:         &d.InstanceType,
+		DBSubnetGroupName:       &i.DbSubnetGroup,
+		Engine:                  &i.DbType,
+		Port:                    aws.Long(DefaultPort(i.DbType)),
+		MultiAZ:                 aws.Boolean(i.MultiAz),
+		AutoMinorVersionUpgrade: d.autoMinorVersionUpgrade(),
+		PubliclyAccessible:      aws.Boolean(false),
+		Tags:                    tags,
+	}
+	resp, err := svc.RestoreDBInstanceFromDBSnapshot(params)
+	log.Println(awsutil.StringValue(resp))
+	if !d.DidAwsCallSucceed(err) {
+		return InstanceNotCreated, err
+	}
+	i.RestorePending = true
+	return InstanceInProgress, nil
+}
+
+// cloneDB takes a snapshot of the SourceDatabase of the instance. RestoreClone creates the instance from it
+// once it is available. The snapshot is tagged like the final snapshots and deleted by FinishRestore.
+func (d *DedicatedDBAdapter) cloneDB(svc *rds.RDS, i *Instance, tags []*rds.Tag) (DBInstanceState, error) {
+	i.SourceSnapshotId = i.CloneSnapshotName()
+	params := &rds.CreateDBSnapshotInput{
+		DBInstanceIdentifier: &i.SourceDatabase,
+		DBSnapshotIdentifier: &i.SourceSnapshotId,
+		Tags:                 append(tags, snapshotTags(i)...),
+	}
+	resp, err := svc.CreateDBSnapshot(params)
+	log.Println(awsutil.StringValue(resp))
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		return InstanceNotCreated, ErrSourceInstanceNotAllowed
+	}
+	if !d.DidAwsCallSucceed(err) {
+		return InstanceNotCreated, err
+	}
+	i.SnapshotPending = true
+	return InstanceInProgress, nil
+}
+
+// RestoreClone creates the clone from the snapshot of its source once the snapshot is available.
+// It returns false while the snapshot is being taken.
+func (d *DedicatedDBAdapter) RestoreClone(i *Instance) (bool, error) {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	snapshots, err := svc.DescribeDBSnapshots(&rds.DescribeDBSnapshotsInput{
+		DBSnapshotIdentifier: &i.SourceSnapshotId,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(snapshots.DBSnapshots) != 1 {
+		return false, errors.New("The snapshot of the source instance cannot be found")
+	}
+	snapshot := snapshots.DBSnapshots[0]
+	if snapshot.Status != nil && *snapshot.Status == "creating" {
+		return false, nil
+	}
+	if _, err := d.restoreFromSnapshot(svc, i, snapshot, instanceTags(i)); err != nil {
+		return false, err
+	}
+	i.SnapshotPending = false
+	return true, nil
+}
+
+// restoreDBToPointInTime creates the instance from its SourceDatabase as it was at its RestoreTime, which has to be
+// in the restorable window of the source. Like restoreDB, the data, the master user and the engine version come
+// from the source and the settings of the broker are applied by FinishRestore.
+func (d *DedicatedDBAdapter) restoreDBToPointInTime(svc *rds.RDS, i *Instance, tags []*rds.Tag) (DBInstanceState, error) {
+	resp, err := svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: &i.SourceDatabase,
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBInstanceNotFound" {
+		return InstanceNotCreated, ErrSourceInstanceNotAllowed
+	}
+	if err != nil {
+		return InstanceNotCreated, err
+	}
+	if len(resp.DBInstances) != 1 {
+		return InstanceNotCreated, ErrSourceInstanceNotAllowed
+	}
+	source := resp.DBInstances[0]
+
+	earliest, latest := restorableWindow(source, time.Now())
+	if latest.IsZero() || i.RestoreTime.Before(earliest) || i.RestoreTime.After(latest) {
+		return InstanceNotCreated, &RestoreWindowError{Earliest: earliest, Latest: latest}
+	}
+
+	i.Username = *source.MasterUsername
+	if source.EngineVersion != nil {
+		i.EngineVersion = *source.EngineVersion
+	}
+	// The storage can't be smaller than the one of the source.
+	if source.AllocatedStorage != nil && *source.AllocatedStorage > i.DbStorage {
+		i.DbStorage = *source.AllocatedStorage
+	}
+
+	params := &rds.RestoreDBInstanceToPointInTimeInput{
+		SourceDBInstanceIdentifier: &i.SourceDatabase,
+		TargetDBInstanceIdentifier: &i.Database,
+		RestoreTime:                &i.RestoreTime,
+		DBInstanceClass:            &d.InstanceType,
+		DBSubnetGroupName:          &i.DbSubnetGroup,
+		Engine:                     &i.DbType,
+		Port:                       aws.Long(DefaultPort(i.DbType)),
+		MultiAZ:                    aws.Boolean(i.MultiAz),
+		AutoMinorVersionUpgrade:    d.autoMinorVersionUpgrade(),
+		PubliclyAccessible:         aws.Boolean(false),
+		Tags:                       tags,
+	}
+	restoreResp, err := svc.RestoreDBInstanceToPointInTime(params)
+	log.Println(awsutil.StringValue(restoreResp))
+	if !d.DidAwsCallSucceed(err) {
+		return InstanceNotCreated, err
+	}
+	i.RestorePending = true
+	return InstanceInProgress, nil
+}
+
+// restorableWindow returns the times the instance can be restored at. The window starts when the oldest
+// automated backup was taken, at most BackupRetentionPeriod days ago, and ends at the LatestRestorableTime.
+// The latest time is zero when the instance has no automated backups.
+func restorableWindow(dbInstance *rds.DBInstance, now time.Time) (earliest, latest time.Time) {
+	if dbInstance.BackupRetentionPeriod == nil || *dbInstance.BackupRetentionPeriod == 0 || dbInstance.LatestRestorableTime == nil {
+		return time.Time{}, time.Time{}
+	}
+	earliest = now.AddDate(0, 0, -int(*dbInstance.BackupRetentionPeriod))
+	if dbInstance.InstanceCreateTime != nil && dbInstance.InstanceCreateTime.After(earliest) {
+		earliest = *dbInstance.InstanceCreateTime
+	}
+	return earliest.UTC(), dbInstance.LatestRestorableTime.UTC()
+}
+
+// orgSnapshot returns the snapshot to restore the instance from, if it is tagged with the organization of the instance.
+func (d *DedicatedDBAdapter) orgSnapshot(svc *rds.RDS, i *Instance) (*rds.DBSnapshot, error) {
+	if d.AccountId == "" {
+		return nil, errors.New("The AWS account is not set, the snapshots can't be checked")
+	}
+	snapshots, err := svc.DescribeDBSnapshots(&rds.DescribeDBSnapshotsInput{
+		DBSnapshotIdentifier: aws.String(i.SourceSnapshotId),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "DBSnapshotNotFound" {
+		return nil, ErrSnapshotNotAllowed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots.DBSnapshots) != 1 {
+		return nil, ErrSnapshotNotAllowed
+	}
+
+	tags, err := svc.ListTagsForResource(&rds.ListTagsForResourceInput{
+		ResourceName: aws.String(rdsSnapshotArn(i.AwsRegion, d.AccountId, i.SourceSnapshotId)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags.TagList {
+		if tag.Key != nil && *tag.Key == "org_guid" && tag.Value != nil && *tag.Value == i.OrgGuid {
+			return snapshots.DBSnapshots[0], nil
+		}
+	}
+	return nil, ErrSnapshotNotAllowed
+}
+
+// FinishRestore resets the master password of the restored instance to the one of the broker, and applies
+// the security group, the storage and the backup retention of the instance.
+func (d *DedicatedDBAdapter) FinishRestore(i *Instance, password string) error {
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	resp, err := svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: &i.Database,
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.DBInstances) != 1 {
+		return ErrInstanceNotFound
+	}
+	dbInstance := resp.DBInstances[0]
+	if dbInstance.DBName != nil {
+		i.DbName = *dbInstance.DBName
+	}
+	// The parameter group is created for the engine version of the source, known once restored.
+	if err := d.ApplyEngineParameters(i); err != nil {
+		return err
+	}
+
+	params := &modifyDBInstanceInput{
+		DBInstanceIdentifier: &i.Database,
+		MasterUserPassword:   &password,
+		ApplyImmediately:     aws.Boolean(true),
+	}
+	if d.SecGroup != "" {
+		params.VPCSecurityGroupIDs = []*string{aws.String(d.SecGroup)}
+	}
+	if dbInstance.AllocatedStorage != nil && i.DbStorage > *dbInstance.AllocatedStorage {
+		params.AllocatedStorage = &i.DbStorage
+	}
+	d.applyPlanSettings(i, params)
+	if err := rdsRequest(svc, "ModifyDBInstance", params, &rds.ModifyDBInstanceOutput{}); err != nil {
+		return err
+	}
+
+	// The snapshot taken to clone the instance is not needed anymore.
+	if i.SourceSnapshotId != "" && i.SourceSnapshotId == i.CloneSnapshotName() {
+		_, err := svc.DeleteDBSnapshot(&rds.DeleteDBSnapshotInput{DBSnapshotIdentifier: &i.SourceSnapshotId})
+		if err != nil {
+			log.Println("Unable to delete the snapshot " + i.SourceSnapshotId + " of the clone: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// TagFinalSnapshot tags the final snapshot of the instance with the organization, space and uuid of the instance.
+// RDS takes the snapshot while it deletes the instance, it is tagged once the instance is gone.
+func (d *DedicatedDBAdapter) TagFinalSnapshot(i *Instance) error {
+	if d.AccountId == "" {
+		return errors.New("The AWS account is not set, the snapshots can't be tagged")
+	}
+	svc := rds.New(&aws.Config{Region: i.AwsRegion})
+	params := &rds.AddTagsToResourceInput{
+		ResourceName: aws.String(rdsSnapshotArn(i.AwsRegion, d.AccountId, i.FinalSnapshotId)),
+		Tags:         snapshotTags(i),
+	}
+	_, err := svc.AddTagsToResource(params)
+	return err
+}
+
+// instanceTags returns the tags of the settings of the broker, which the RDS instances get.
+func instanceTags(i *Instance) []*rds.Tag {
+	var rdsTags []*rds.Tag
+	for k, v := range i.Tags {
+		rdsTags = append(rdsTags, &rds.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return rdsTags
+}
+
+// snapshotTags returns the tags of the snapshots of an instance, the organization of the instance
+// can restore the snapshots tagged with it.
+func snapshotTags(i *Instance) []*rds.Tag {
+	return []*rds.Tag{
+		{Key: aws.String("instance_uuid"), Value: aws.String(i.Uuid)},
+		{Key: aws.String("org_guid"), Value: aws.String(i.OrgGuid)},
+		{Key: aws.String("space_guid"), Value: aws.String(i.SpaceGuid)},
+	}
+}
+
+// rdsSnapshotArn returns the ARN of a snapshot, the SDK does not return it.
+func rdsSnapshotArn(region, accountId, snapshotId string) string {
+	return rdsArn(region, accountId, "snapshot:"+snapshotId)
+}
+
+// rdsClusterSnapshotArn returns the ARN of a snapshot of an Aurora cluster.
+func rdsClusterSnapshotArn(region, accountId, snapshotId string) string {
+	return rdsArn(region, accountId, "cluster-snapshot:"+snapshotId)
+}
+
+// rdsArn returns the ARN of an RDS resource, given as type:name.
+func rdsArn(region, accountId, resource string) string {
+	partition := "aws"
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		partition = "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		partition = "aws-cn"
+	}
+	return fmt.Sprintf("arn:%s:rds:%s:%s:%s", partition, region, accountId, resource)
+}
+
 func (d *DedicatedDBAdapter) DidAwsCallSucceed(err error) bool {
 	// TODO Eventually return a formatted error object.
 	if err != nil {
@@ -295,3 +1485,165 @@ func (d *DedicatedDBAdapter) DidAwsCallSucceed(err error) bool {
 	}
 	return true
 }
+
+// postgresOwnerRole is the role owning the objects of a dedicated Postgres instance.
+// The bindings are members of it rather than of the master user, which can create roles.
+const postgresOwnerRole = "broker_owner"
+
+// preparePostgresOwnerRole creates the owner role of a dedicated instance if it is missing, the master user being a member of it.
+// The objects the bindings created as the master user, before the owner role, are handed over to it, and the bindings
+// become members of the owner role instead of the master user.
+func preparePostgresOwnerRole(conn *gorm.DB, master string) error {
+	var count int64
+	if err := conn.DB().QueryRow("SELECT count(*) FROM pg_roles WHERE rolname = $1;", postgresOwnerRole).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	members, err := postgresRoleMembers(conn, master)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		postgresCreateRole(postgresOwnerRole),
+		postgresGrantRoleToCurrentUser(postgresOwnerRole),
+		postgresReassignOwned(master, postgresOwnerRole),
+	}
+	for _, member := range members {
+		statements = append(statements,
+			postgresRevokeRole(master, member),
+			postgresGrantRole(postgresOwnerRole, member),
+			postgresSetRole(member, postgresOwnerRole))
+	}
+	tx, err := conn.DB().Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// postgresRoleMembers returns the roles which are members of the role, but the current user.
+func postgresRoleMembers(conn *gorm.DB, role string) ([]string, error) {
+	rows, err := conn.DB().Query("SELECT r.rolname FROM pg_auth_members m JOIN pg_roles r ON r.oid = m.member "+
+		"WHERE m.roleid = (SELECT oid FROM pg_roles WHERE rolname = $1) AND r.rolname <> current_user;", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// createPostgresBindingRole creates the login role of a binding.
+// The role is a member of the role owning the instance and switches to it on login, so the objects
+// it creates are owned by the instance and outlive the binding.
+func createPostgresBindingRole(conn *gorm.DB, role string, b *Binding) error {
+	if err := execSQL(conn, postgresCreateUserInRole(b.Username, b.ClearPassword, role)); err != nil {
+		return err
+	}
+	if err := execSQL(conn, postgresSetRole(b.Username, role)); err != nil {
+		execSQL(conn, postgresDropUser(b.Username))
+		return err
+	}
+	return nil
+}
+
+// dropPostgresBindingRole terminates the open sessions of a binding and drops its role.
+// The role can't be dropped while it owns objects or holds privileges: its objects are handed over to the owner
+// role and its privileges are revoked first. conn is connected to the server, dbConn to the database of the instance,
+// both can be the same connection. A role which is already gone is skipped, so that an unbinding can be retried.
+func dropPostgresBindingRole(conn *gorm.DB, dbConn *gorm.DB, owner string, b *Binding) error {
+	if _, err := conn.DB().Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1;", b.Username); err != nil {
+		return err
+	}
+	var count int64
+	if err := conn.DB().QueryRow("SELECT count(*) FROM pg_roles WHERE rolname = $1;", b.Username).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	tx, err := dbConn.DB().Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		postgresGrantRoleToCurrentUser(b.Username),
+		postgresReassignOwned(b.Username, owner),
+		postgresDropOwned(b.Username),
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return execSQL(conn, postgresDropUser(b.Username))
+}
+
+// createMySQLBindingUser creates the user of a binding with all the privileges on the database of the instance.
+func createMySQLBindingUser(conn *gorm.DB, i *Instance, b *Binding) error {
+	if err := execSQL(conn, mysqlCreateUser(b.Username, b.ClearPassword)); err != nil {
+		return err
+	}
+	if err := execSQL(conn, mysqlGrantDatabase(i.DatabaseName(), b.Username)); err != nil {
+		execSQL(conn, mysqlDropUser(b.Username))
+		return err
+	}
+	return nil
+}
+
+// mysqlErrUnknownUser is the error of MySQL when a user to drop does not exist (ER_CANNOT_USER).
+const mysqlErrUnknownUser uint16 = 1396
+
+// isMySQLError tells if the error is the MySQL error with the number.
+func isMySQLError(err error, number uint16) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == number
+}
+
+// dropMySQLBindingUser drops the user of a binding, then ends its open sessions with the kill statement.
+// The statement is a FormatSQL format that takes the id of the session.
+func dropMySQLBindingUser(conn *gorm.DB, b *Binding, kill string) error {
+	// The user is gone when DROP USER fails with mysqlErrUnknownUser, e.g. an unbinding is retried.
+	if err := execSQL(conn, mysqlDropUser(b.Username)); err != nil && !isMySQLError(err, mysqlErrUnknownUser) {
+		return err
+	}
+	rows, err := conn.DB().Query("SELECT id FROM information_schema.PROCESSLIST WHERE user = ?;", b.Username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		// The session may be gone already, there is nothing to do then.
+		execSQL(conn, FormatSQL(MySQLDialect, kill, id))
+	}
+	return nil
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRDSSnapshotArn(t *testing.T) {
+	arns := map[string]string{
+		"us-east-1":     "arn:aws:rds:us-east-1:123456789012:snapshot:final-a",
+		"us-gov-west-1": "arn:aws-us-gov:rds:us-gov-west-1:123456789012:snapshot:final-a",
+		"cn-north-1":    "arn:aws-cn:rds:cn-north-1:123456789012:snapshot:final-a",
+	}
+	for region, arn := range arns {
+		if got := rdsSnapshotArn(region, "123456789012", "final-a"); got != arn {
+			t.Error("The snapshot in", region, "should be", arn, "and it is", got)
+		}
+	}
+}
+
+func TestRDSClusterSnapshotArn(t *testing.T) {
+	arn := "arn:aws:rds:us-east-1:123456789012:cluster-snapshot:final-a"
+	if got := rdsClusterSnapshotArn("us-east-1", "123456789012", "final-a"); got != arn {
+		t.Error("The cluster snapshot should be", arn, "and it is", got)
+	}
+}
+
+func TestSharedDBAdapterRoleLimits(t *testing.T) {
+	d := SharedDBAdapter{Plan: &Plan{}}
+	if limits := d.roleLimits("u1"); len(limits) != 0 {
+		t.Error("A plan without limits should not limit the roles, it limits with", limits)
+	}
+
+	plan := *catalog.fetchPlan("db80ca29-2d1b-4fbc-aad3-d03c0bfa7593", "44d24fc7-f7a4-4ac1-b7a0-de82836e89a3")
+	plan.IdleInTransactionSessionTimeout = "1min"
+	d.Plan = &plan
+	expected := []string{
+		`ALTER ROLE "u1" CONNECTION LIMIT 10;`,
+		`ALTER ROLE "u1" SET "statement_timeout" = '15min';`,
+		`ALTER ROLE "u1" SET "idle_in_transaction_session_timeout" = '1min';`,
+	}
+	if limits := d.roleLimits("u1"); !reflect.DeepEqual(limits, expected) {
+		t.Error("The roles should be limited with", expected, "and they are limited with", limits)
+	}
+}
+
+func TestRestorableWindow(t *testing.T) {
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+	latest := now.Add(-5 * time.Minute)
+	dbInstance := &rds.DBInstance{
+		BackupRetentionPeriod: aws.Long(7),
+		LatestRestorableTime:  &latest,
+		InstanceCreateTime:    aws.Time(now.AddDate(0, -1, 0)),
+	}
+	earliest, got := restorableWindow(dbInstance, now)
+	if !earliest.Equal(now.AddDate(0, 0, -7)) || !got.Equal(latest) {
+		t.Error("The window should span the retention period and it is", earliest, got)
+	}
+
+	// The window can't start before the instance was created.
+	created := now.AddDate(0, 0, -2)
+	dbInstance.InstanceCreateTime = &created
+	if earliest, _ := restorableWindow(dbInstance, now); !earliest.Equal(created) {
+		t.Error("The window should start when the instance was created and it starts", earliest)
+	}
+
+	dbInstance.BackupRetentionPeriod = aws.Long(0)
+	if _, got := restorableWindow(dbInstance, now); !got.IsZero() {
+		t.Error("An instance without backups should not be restorable")
+	}
+}
+
+func TestCompareEngineVersions(t *testing.T) {
+	versions := []struct {
+		a, b     string
+		expected int
+	}{
+		{"9.6.22", "9.6.3", 1},
+		{"9.6.3", "9.6.22", -1},
+		{"10.4", "9.6.22", 1},
+		{"9.6", "9.6.22", 0},
+		{"9.6.22", "9.6.22", 0},
+		{"5.7.mysql_aurora.2.10", "5.7.mysql_aurora.2.9", 1},
+	}
+	for _, v := range versions {
+		got := compareEngineVersions(v.a, v.b)
+		if (got > 0) != (v.expected > 0) || (got < 0) != (v.expected < 0) {
+			t.Error("Comparing", v.a, "to", v.b, "should give", v.expected, "and it gives", got)
+		}
+	}
+}
+
+func TestMajorEngineVersion(t *testing.T) {
+	versions := []struct {
+		engine, version, major string
+	}{
+		{"postgres", "9.6.22", "9.6"},
+		{"postgres", "12.7", "12"},
+		{"postgres", "12", "12"},
+		{"mysql", "5.7.33", "5.7"},
+		{"mysql", "8.0.25", "8.0"},
+		{"mariadb", "10.5.12", "10.5"},
+	}
+	for _, v := range versions {
+		if got := majorEngineVersion(v.engine, v.version); got != v.major {
+			t.Error("The major version of", v.engine, v.version, "should be", v.major, "and it is", got)
+		}
+	}
+}
+
+// recordingDriver is a database/sql driver recording the statements it runs, in place of a database server.
+// Every query returns Row, fail makes a statement fail given the statements run before it.
+type recordingDriver struct {
+	Row        []driver.Value
+	fail       func(statement string, previous []string) error
+	mu         sync.Mutex
+	statements []string
+}
+
+var recordingDrivers int
+
+// openRecordingDB registers the driver under a name of its own and opens a connection with it.
+func openRecordingDB(t *testing.T, dialect string, d *recordingDriver) *gorm.DB {
+	recordingDrivers++
+	name := fmt.Sprintf("recording%d", recordingDrivers)
+	sql.Register(name, d)
+	conn, err := gorm.Open(dialect, name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &conn
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d}, nil
+}
+
+func (d *recordingDriver) run(statement string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fail != nil {
+		if err := d.fail(statement, d.statements); err != nil {
+			return err
+		}
+	}
+	d.statements = append(d.statements, statement)
+	return nil
+}
+
+// Statements returns the statements run so far.
+func (d *recordingDriver) Statements() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.statements...)
+}
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d, query}, nil
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return c, c.d.run("BEGIN;")
+}
+
+func (c *recordingConn) Commit() error { return c.d.run("COMMIT;") }
+
+func (c *recordingConn) Rollback() error { return c.d.run("ROLLBACK;") }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error { return nil }
+
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), s.d.run(s.query)
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.d.run(s.query); err != nil {
+		return nil, err
+	}
+	return &recordingRows{row: s.d.Row}, nil
+}
+
+type recordingRows struct {
+	row []driver.Value
+}
+
+func (r *recordingRows) Columns() []string {
+	columns := make([]string, len(r.row))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i)
+	}
+	return columns
+}
+
+func (r *recordingRows) Close() error { return nil }
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+func TestDropPostgresBindingRoleOwningObjects(t *testing.T) {
+	// The binding reset its role and created a table: like Postgres, the role can't be dropped
+	// while the table is owned by it.
+	owned := true
+	d := &recordingDriver{Row: []driver.Value{int64(1)}}
+	d.fail = func(statement string, previous []string) error {
+		switch {
+		case strings.HasPrefix(statement, "REASSIGN OWNED BY"):
+			owned = false
+		case strings.HasPrefix(statement, "DROP USER") && owned:
+			return errors.New(`role "binding" cannot be dropped because some objects depend on it`)
+		}
+		return nil
+	}
+	conn := openRecordingDB(t, "postgres", d)
+
+	if err := dropPostgresBindingRole(conn, conn, postgresOwnerRole, &Binding{Username: "binding"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1;",
+		"SELECT count(*) FROM pg_roles WHERE rolname = $1;",
+		"BEGIN;",
+		`GRANT "binding" TO CURRENT_USER;`,
+		`REASSIGN OWNED BY "binding" TO "broker_owner";`,
+		`DROP OWNED BY "binding";`,
+		"COMMIT;",
+		`DROP USER IF EXISTS "binding";`,
+	}
+	if statements := d.Statements(); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("The statements should be %v, not %v", expected, statements)
+	}
+}
+
+func TestDropPostgresBindingRoleGone(t *testing.T) {
+	d := &recordingDriver{Row: []driver.Value{int64(0)}}
+	conn := openRecordingDB(t, "postgres", d)
+
+	if err := dropPostgresBindingRole(conn, conn, "instance", &Binding{Username: "binding"}); err != nil {
+		t.Fatal(err)
+	}
+	if statements := d.Statements(); len(statements) != 2 {
+		t.Errorf("Only the sessions and the role should be looked up, not %v", statements)
+	}
+}
+
+func TestDropMySQLBindingUserGone(t *testing.T) {
+	d := &recordingDriver{}
+	d.fail = func(statement string, previous []string) error {
+		if strings.HasPrefix(statement, "DROP USER") {
+			return &mysql.MySQLError{Number: mysqlErrUnknownUser, Message: "Operation DROP USER failed"}
+		}
+		return nil
+	}
+	conn := openRecordingDB(t, "mysql", d)
+
+	if err := dropMySQLBindingUser(conn, &Binding{Username: "binding"}, "KILL %d;"); err != nil {
+		t.Errorf("A binding user already gone should be dropped, not fail with %v", err)
+	}
+}
+
+// rdsTestServer answers the RDS actions with their XML response in place of RDS, and records the queries it gets.
+// The RDS clients send their requests to it until it is closed.
+func rdsTestServer(t *testing.T, responses map[string]string) (*[]url.Values, func()) {
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, r.PostForm)
+		action := r.PostForm.Get("Action")
+		response, ok := responses[action]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			response = "<ErrorResponse><Error><Code>InvalidAction</Code><Message>Unexpected " + action + "</Message></Error></ErrorResponse>"
+		} else if strings.HasPrefix(response, "<ErrorResponse>") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(response))
+	}))
+
+	defaultConfig := aws.DefaultConfig
+	config := *defaultConfig
+	config.Endpoint = server.URL
+	config.Credentials = credentials.NewStaticCredentials("id", "secret", "")
+	aws.DefaultConfig = &config
+	return &queries, func() {
+		aws.DefaultConfig = defaultConfig
+		server.Close()
+	}
+}
+
+// rdsResponse returns the XML response of an RDS action with its result.
+func rdsResponse(action, result string) string {
+	return "<" + action + "Response><" + action + "Result>" + result + "</" + action + "Result></" + action + "Response>"
+}
+
+func TestDedicatedDBAdapterMajorUpgradeParameterGroup(t *testing.T) {
+	responses := map[string]string{
+		"DescribeDBInstances":      rdsResponse("DescribeDBInstances", "<DBInstances><DBInstance><EngineVersion>13.7</EngineVersion></DBInstance></DBInstances>"),
+		"DescribeDBEngineVersions": rdsResponse("DescribeDBEngineVersions", "<DBEngineVersions><DBEngineVersion><DBParameterGroupFamily>postgres14</DBParameterGroupFamily></DBEngineVersion></DBEngineVersions>"),
+		"CreateDBParameterGroup":   rdsResponse("CreateDBParameterGroup", ""),
+		"ModifyDBParameterGroup":   rdsResponse("ModifyDBParameterGroup", ""),
+		"ModifyDBInstance":         rdsResponse("ModifyDBInstance", ""),
+		"DeleteDBParameterGroup":   rdsResponse("DeleteDBParameterGroup", ""),
+	}
+	queries, closeServer := rdsTestServer(t, responses)
+	defer closeServer()
+
+	d := &DedicatedDBAdapter{InstanceType: "db.m5.large", Plan: &Plan{}}
+	i := &Instance{
+		Uuid:              "the_instance",
+		Database:          "db1",
+		DbType:            "postgres",
+		AwsRegion:         "us-east-1",
+		EngineVersion:     "13.7",
+		EngineParameters:  `{"work_mem": "64MB"}`,
+		ParameterGroup:    "broker-db1",
+		PlanEngineVersion: "14.3",
+	}
+	if state, err := d.UpdateDB(i); state != InstanceInProgress {
+		t.Fatal("The instance should be upgraded:", err)
+	}
+
+	var actions []string
+	for _, query := range *queries {
+		actions = append(actions, query.Get("Action"))
+	}
+	expected := []string{"DescribeDBInstances", "DescribeDBEngineVersions", "CreateDBParameterGroup", "ModifyDBParameterGroup", "ModifyDBInstance"}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("The actions should be %v, not %v", expected, actions)
+	}
+	create, modifyGroup, modifyInstance := (*queries)[2], (*queries)[3], (*queries)[4]
+	if create.Get("DBParameterGroupName") != "broker-db1-14" || create.Get("DBParameterGroupFamily") != "postgres14" {
+		t.Errorf("A parameter group of the new family should be created, not %v", create)
+	}
+	if modifyGroup.Get("DBParameterGroupName") != "broker-db1-14" ||
+		modifyGroup.Get("Parameters.member.1.ParameterName") != "work_mem" || modifyGroup.Get("Parameters.member.1.ParameterValue") != "64MB" {
+		t.Errorf("The engine parameters should be set in the new parameter group, not with %v", modifyGroup)
+	}
+	if modifyInstance.Get("DBParameterGroupName") != "broker-db1-14" || modifyInstance.Get("EngineVersion") != "14.3" ||
+		modifyInstance.Get("AllowMajorVersionUpgrade") != "true" {
+		t.Errorf("The instance should be upgraded with the new parameter group, not with %v", modifyInstance)
+	}
+	if i.ParameterGroup != "broker-db1-14" || i.PreviousParameterGroup != "broker-db1" {
+		t.Errorf("The instance should have the new parameter group and remember the previous one, not %q and %q", i.ParameterGroup, i.PreviousParameterGroup)
+	}
+
+	// The previous group is deleted once the upgraded instance runs with the new one.
+	responses["DescribeDBInstances"] = rdsResponse("DescribeDBInstances", "<DBInstances><DBInstance><DBInstanceStatus>available</DBInstanceStatus>"+
+		"<DBParameterGroups><DBParameterGroup><DBParameterGroupName>broker-db1-14</DBParameterGroupName>"+
+		"<ParameterApplyStatus>in-sync</ParameterApplyStatus></DBParameterGroup></DBParameterGroups></DBInstance></DBInstances>")
+	*queries = nil
+	if status, err := d.GetDBStatus(i); err != nil || status.State != InstanceCreationSucceeded {
+		t.Fatal("The upgraded instance should be available:", status, err)
+	}
+	if len(*queries) != 2 || (*queries)[1].Get("Action") != "DeleteDBParameterGroup" || (*queries)[1].Get("DBParameterGroupName") != "broker-db1" {
+		t.Errorf("The previous parameter group should be deleted, not with %v", *queries)
+	}
+	if i.PreviousParameterGroup != "" {
+		t.Error("The deleted parameter group should be forgotten")
+	}
+}
+
+func TestDedicatedDBAdapterMajorUpgradePlanParameterGroup(t *testing.T) {
+	queries, closeServer := rdsTestServer(t, map[string]string{
+		"DescribeDBInstances":      rdsResponse("DescribeDBInstances", "<DBInstances><DBInstance><EngineVersion>13.7</EngineVersion></DBInstance></DBInstances>"),
+		"DescribeDBEngineVersions": rdsResponse("DescribeDBEngineVersions", "<DBEngineVersions><DBEngineVersion><DBParameterGroupFamily>postgres14</DBParameterGroupFamily></DBEngineVersion></DBEngineVersions>"),
+		// The group of the plan belongs to the family of the version the instance runs.
+		"DescribeDBParameterGroups": rdsResponse("DescribeDBParameterGroups", "<DBParameterGroups><DBParameterGroup><DBParameterGroupName>plan-group</DBParameterGroupName>"+
+			"<DBParameterGroupFamily>postgres13</DBParameterGroupFamily></DBParameterGroup></DBParameterGroups>"),
+		"CreateDBParameterGroup": rdsResponse("CreateDBParameterGroup", ""),
+		"ModifyDBInstance":       rdsResponse("ModifyDBInstance", ""),
+	})
+	defer closeServer()
+
+	d := &DedicatedDBAdapter{InstanceType: "db.m5.large", Plan: &Plan{ParameterGroup: "plan-group"}}
+	i := &Instance{
+		Uuid:              "the_instance",
+		Database:          "db1",
+		DbType:            "postgres",
+		AwsRegion:         "us-east-1",
+		EngineVersion:     "13.7",
+		PlanEngineVersion: "14.3",
+	}
+	if state, err := d.UpdateDB(i); state != InstanceInProgress {
+		t.Fatal("The instance should be upgraded:", err)
+	}
+
+	var actions []string
+	for _, query := range *queries {
+		actions = append(actions, query.Get("Action"))
+	}
+	expected := []string{"DescribeDBInstances", "DescribeDBEngineVersions", "DescribeDBParameterGroups", "CreateDBParameterGroup", "ModifyDBInstance"}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("The actions should be %v, not %v", expected, actions)
+	}
+	create, modifyInstance := (*queries)[3], (*queries)[4]
+	if create.Get("DBParameterGroupName") != "broker-db1-14" || create.Get("DBParameterGroupFamily") != "postgres14" {
+		t.Errorf("A parameter group of the new family should be created, not %v", create)
+	}
+	if modifyInstance.Get("DBParameterGroupName") != "broker-db1-14" || modifyInstance.Get("EngineVersion") != "14.3" {
+		t.Errorf("The instance should be upgraded with the new parameter group, not with %v", modifyInstance)
+	}
+	// The group of the plan is not the broker's to delete.
+	if i.ParameterGroup != "broker-db1-14" || i.PreviousParameterGroup != "" {
+		t.Errorf("The instance should have the new parameter group only, not %q and %q", i.ParameterGroup, i.PreviousParameterGroup)
+	}
+}
+
+func TestDedicatedDBAdapterApplyEngineParametersExistingGroup(t *testing.T) {
+	// The group was created by an update which failed afterwards.
+	queries, closeServer := rdsTestServer(t, map[string]string{
+		"DescribeDBInstances":      rdsResponse("DescribeDBInstances", "<DBInstances><DBInstance><EngineVersion>13.7</EngineVersion></DBInstance></DBInstances>"),
+		"DescribeDBEngineVersions": rdsResponse("DescribeDBEngineVersions", "<DBEngineVersions><DBEngineVersion><DBParameterGroupFamily>postgres13</DBParameterGroupFamily></DBEngineVersion></DBEngineVersions>"),
+		"CreateDBParameterGroup":   "<ErrorResponse><Error><Code>DBParameterGroupAlreadyExists</Code><Message>Parameter group broker-db1 already exists</Message></Error></ErrorResponse>",
+		"ModifyDBParameterGroup":   rdsResponse("ModifyDBParameterGroup", ""),
+	})
+	defer closeServer()
+
+	d := &DedicatedDBAdapter{Plan: &Plan{}}
+	i := &Instance{
+		Uuid:             "the_instance",
+		Database:         "db1",
+		DbType:           "postgres",
+		AwsRegion:        "us-east-1",
+		EngineParameters: `{"work_mem": "64MB"}`,
+	}
+	if err := d.ApplyEngineParameters(i); err != nil {
+		t.Fatal("The existing parameter group should be used:", err)
+	}
+	if i.ParameterGroup != "broker-db1" {
+		t.Errorf("The instance should have the parameter group broker-db1, not %q", i.ParameterGroup)
+	}
+	modifyGroup := (*queries)[len(*queries)-1]
+	if modifyGroup.Get("Action") != "ModifyDBParameterGroup" || modifyGroup.Get("DBParameterGroupName") != "broker-db1" {
+		t.Errorf("The engine parameters should be set in the existing parameter group, not with %v", modifyGroup)
+	}
+}
+
+func TestDedicatedDBAdapterMaxAllocatedStorage(t *testing.T) {
+	queries, closeServer := rdsTestServer(t, map[string]string{
+		// The storage autoscaling grew the storage of the instance to 120 GB.
+		"DescribeDBInstances": rdsResponse("DescribeDBInstances", "<DBInstances><DBInstance><AllocatedStorage>120</AllocatedStorage>"+
+			"<EngineVersion>13.7</EngineVersion></DBInstance></DBInstances>"),
+		"CreateDBInstance": rdsResponse("CreateDBInstance", "<DBInstance><DBInstanceIdentifier>db1</DBInstanceIdentifier></DBInstance>"),
+		"ModifyDBInstance": rdsResponse("ModifyDBInstance", "<DBInstance><DBInstanceIdentifier>db1</DBInstanceIdentifier></DBInstance>"),
+	})
+	defer closeServer()
+
+	d := &DedicatedDBAdapter{InstanceType: "db.m5.large", Plan: &Plan{}}
+	i := &Instance{
+		Uuid:                "the_instance",
+		Database:            "db1",
+		Username:            "u1",
+		DbType:              "postgres",
+		AwsRegion:           "us-east-1",
+		DbStorage:           100,
+		MaxAllocatedStorage: 500,
+	}
+	if state, err := d.CreateDB(i, "secret"); state != InstanceInProgress {
+		t.Fatal("The instance should be created:", err)
+	}
+	create := (*queries)[len(*queries)-1]
+	if create.Get("Action") != "CreateDBInstance" || create.Get("AllocatedStorage") != "100" || create.Get("MaxAllocatedStorage") != "500" {
+		t.Errorf("The instance should be created with its storage limit, not with %v", create)
+	}
+
+	*queries = nil
+	if state, err := d.UpdateDB(i); state != InstanceInProgress {
+		t.Fatal("The instance should be updated:", err)
+	}
+	modify := (*queries)[len(*queries)-1]
+	if modify.Get("Action") != "ModifyDBInstance" || modify.Get("AllocatedStorage") != "120" || modify.Get("MaxAllocatedStorage") != "500" {
+		t.Errorf("The instance should keep the storage it grew to and its storage limit, not be modified with %v", modify)
+	}
+	if i.DbStorage != 120 {
+		t.Error("The instance should have the storage it grew to and it has", i.DbStorage)
+	}
+}
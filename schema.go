@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// JSONSchema holds the subset of JSON Schema (draft 4) used to describe and validate
+// the parameters accepted by the plans. It is declared in catalog.yaml and published in the catalog.
+// Supported keywords:
+// * type - One of object, string, integer, number and boolean
+// * properties, required and additionalProperties - For objects
+// * enum - Allowed values
+// * minimum and maximum - For integers and numbers
+// * minLength, maxLength and pattern - For strings
+type JSONSchema struct {
+	Schema               string                 `yaml:"$schema" json:"$schema,omitempty"`
+	Type                 string                 `yaml:"type" json:"type,omitempty"`
+	Description          string                 `yaml:"description" json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `yaml:"properties" json:"properties,omitempty"`
+	Required             []string               `yaml:"required" json:"required,omitempty"`
+	AdditionalProperties *bool                  `yaml:"additionalProperties" json:"additionalProperties,omitempty"`
+	Enum                 []interface{}          `yaml:"enum" json:"enum,omitempty"`
+	Minimum              *float64               `yaml:"minimum" json:"minimum,omitempty"`
+	Maximum              *float64               `yaml:"maximum" json:"maximum,omitempty"`
+	MinLength            *int                   `yaml:"minLength" json:"minLength,omitempty"`
+	MaxLength            *int                   `yaml:"maxLength" json:"maxLength,omitempty"`
+	Pattern              string                 `yaml:"pattern" json:"pattern,omitempty"`
+}
+
+// ValidateJSON checks that the raw JSON document is valid against the schema.
+// An empty document is treated as an empty object.
+func (s *JSONSchema) ValidateJSON(name string, raw []byte) error {
+	var value interface{} = map[string]interface{}{}
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return errors.New(name + " is not valid JSON")
+		}
+	}
+	return s.Validate(name, value)
+}
+
+// Validate checks that the decoded JSON value is valid against the schema.
+// The name is used to point to the invalid value in the error.
+func (s *JSONSchema) Validate(name string, value interface{}) error {
+	if s == nil {
+		return nil
+	}
+
+	if s.Type != "" && !isJSONType(s.Type, value) {
+		return fmt.Errorf("%s must be of type %s", name, s.Type)
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(normalizeJSONValue(allowed), value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %s", name, formatJSONValues(s.Enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s must be greater than or equal to %v", name, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s must be less than or equal to %v", name, *s.Maximum)
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", name, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", name, *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			matched, err := regexp.MatchString(s.Pattern, v)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				return fmt.Errorf("%s must match the pattern %s", name, s.Pattern)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				return fmt.Errorf("%s.%s is required", name, key)
+			}
+		}
+		// Sort the keys so that the reported error does not change between requests.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property, ok := s.Properties[key]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not supported", name, key)
+				}
+				continue
+			}
+			if err := property.Validate(name+"."+key, v[key]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isJSONType tells if a value decoded by encoding/json is of the given JSON Schema type.
+func isJSONType(typ string, value interface{}) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		v, ok := value.(float64)
+		return ok && v == float64(int64(v))
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// normalizeJSONValue converts the numbers decoded from YAML to the float64 used by encoding/json.
+func normalizeJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+func formatJSONValues(values []interface{}) string {
+	formatted := make([]string, len(values))
+	for k, v := range values {
+		b, _ := json.Marshal(v)
+		formatted[k] = string(b)
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateParameters(t *testing.T) {
+	plan := catalog.fetchPlan(
+		"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+		"da91e15c-98c9-46a9-b114-02b8d28062c6",
+	)
+
+	valid := []string{
+		``,
+		`null`,
+		`{}`,
+		`{"storage_gb": 50, "engine_version": "9.4.1", "backup_retention_days": 14, "multi_az": true}`,
+	}
+	for _, raw := range valid {
+		if err := plan.validateCreateParameters([]byte(raw)); err != nil {
+			t.Error(raw, "should be valid and returned", err)
+		}
+	}
+
+	invalid := map[string]string{
+		`[]`:                            "parameters must be of type object",
+		`{"storage_gb": "50"}`:          "parameters.storage_gb must be of type integer",
+		`{"storage_gb": 50.5}`:          "parameters.storage_gb must be of type integer",
+		`{"storage_gb": 1}`:             "parameters.storage_gb must be greater than or equal to 5",
+		`{"backup_retention_days": 36}`: "parameters.backup_retention_days must be less than or equal to 35",
+		`{"engine_version": "latest"}`:  "parameters.engine_version must match the pattern",
+		`{"multi_az": "yes"}`:           "parameters.multi_az must be of type boolean",
+		`{"unknown": 1}`:                "parameters.unknown is not supported",
+		`{`:                             "parameters is not valid JSON",
+	}
+	for raw, expected := range invalid {
+		err := plan.validateCreateParameters([]byte(raw))
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Error(raw, "should fail with", expected, "and returned", err)
+		}
+	}
+}
+
+func TestValidateParametersWithoutSchema(t *testing.T) {
+	plan := Plan{}
+
+	if err := plan.validateCreateParameters([]byte(`{}`)); err != nil {
+		t.Error("Empty parameters should be valid and returned", err)
+	}
+
+	if err := plan.validateCreateParameters([]byte(`{"storage_gb": 50}`)); err == nil {
+		t.Error("A plan without a schema should not accept parameters")
+	}
+}
+
+func TestValidateEnum(t *testing.T) {
+	schema := JSONSchema{Enum: []interface{}{"a", 1}}
+
+	if err := schema.Validate("value", float64(1)); err != nil {
+		t.Error("1 should be valid and returned", err)
+	}
+
+	if err := schema.Validate("value", "b"); err == nil || err.Error() != `value must be one of "a", 1` {
+		t.Error("b should not be valid and returned", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Strategies to place the shared instances on the shared servers.
+const (
+	// PlacementLeastDatabases picks the server hosting the fewest databases.
+	PlacementLeastDatabases string = "least-databases"
+	// PlacementLeastSize picks the server with the least storage allocated to its databases.
+	PlacementLeastSize string = "least-size"
+)
+
+// ErrNoSharedServer is returned when servers are registered for the plan but none can host the instance.
+var ErrNoSharedServer = errors.New("There is no shared server available for the plan")
+
+// SharedServer is a database server hosting the databases of the shared plans.
+// The servers are registered through the admin API.
+type SharedServer struct {
+	Id       int64  `json:"id"`
+	Name     string `sql:"size(255);unique" json:"name"`
+	DbType   string `sql:"size(255)" json:"db_type"`
+	Url      string `sql:"size(255)" json:"url"`
+	Port     int64  `json:"port"`
+	DbName   string `sql:"size(255)" json:"db_name"`
+	Username string `sql:"size(255)" json:"username"`
+	Password string `sql:"size(255)" json:"-"`
+	Salt     string `sql:"size(255)" json:"-"`
+	Sslmode  string `sql:"size(255)" json:"sslmode"`
+	// Tags is a comma separated list of tags matched against the serverTags of the plans.
+	Tags string `sql:"size(255)" json:"tags"`
+	// Enabled tells if new instances can be placed on the server.
+	Enabled bool `json:"enabled"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (server *SharedServer) SetPassword(password, key string) error {
+	if server.Salt == "" {
+		server.Salt = GenerateSalt(aes.BlockSize)
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(server.Salt)
+
+	encrypted, err := Encrypt(password, key, iv)
+	if err != nil {
+		return err
+	}
+
+	server.Password = encrypted
+
+	return nil
+}
+
+func (server *SharedServer) GetPassword(key string) (string, error) {
+	if server.Salt == "" || server.Password == "" {
+		return "", errors.New("Salt and password has to be set before reading the password")
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(server.Salt)
+
+	return Decrypt(server.Password, key, iv)
+}
+
+// DBConfig returns the configuration to connect to the server.
+func (server *SharedServer) DBConfig(key string) (*DBConfig, error) {
+	password, err := server.GetPassword(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DBConfig{
+		DbType:   server.DbType,
+		Url:      server.Url,
+		Port:     server.Port,
+		DbName:   server.DbName,
+		Username: server.Username,
+		Password: password,
+		Sslmode:  server.Sslmode,
+	}, nil
+}
+
+// HasTags tells if the server has all the tags.
+func (server *SharedServer) HasTags(tags []string) bool {
+	own := map[string]bool{}
+	for _, tag := range strings.Split(server.Tags, ",") {
+		own[strings.TrimSpace(tag)] = true
+	}
+	for _, tag := range tags {
+		if !own[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedServerLoad is what a shared server hosts.
+type sharedServerLoad struct {
+	Server    SharedServer
+	Databases int64
+	Storage   int64
+}
+
+// sharedServerLoads sorts the loads with less, the ties going to the oldest server
+// so that the placement does not depend on the order of the rows.
+type sharedServerLoads struct {
+	loads []*sharedServerLoad
+	less  func(a, b *sharedServerLoad) bool
+}
+
+func (l sharedServerLoads) Len() int      { return len(l.loads) }
+func (l sharedServerLoads) Swap(a, b int) { l.loads[a], l.loads[b] = l.loads[b], l.loads[a] }
+func (l sharedServerLoads) Less(a, b int) bool {
+	if l.less(l.loads[a], l.loads[b]) {
+		return true
+	}
+	if l.less(l.loads[b], l.loads[a]) {
+		return false
+	}
+	return l.loads[a].Server.Id < l.loads[b].Server.Id
+}
+
+// PlaceSharedInstance picks the shared server to host a new instance of the plan.
+// Only the enabled servers of the plan database type having all the serverTags of the plan are eligible,
+// the strategy decides between them.
+// No server is returned when none is registered for the database type, the instance then stays on the default server.
+func PlaceSharedInstance(brokerDb *gorm.DB, plan *Plan, strategy string) (*SharedServer, error) {
+	servers := []SharedServer{}
+	if db := brokerDb.Where("db_type = ?", plan.DbType).Find(&servers); db.Error != nil && !db.RecordNotFound() {
+		return nil, db.Error
+	}
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	loads := map[int64]*sharedServerLoad{}
+	candidates := []*sharedServerLoad{}
+	for _, server := range servers {
+		if !server.Enabled || !server.HasTags(plan.ServerTags) {
+			continue
+		}
+		load := &sharedServerLoad{Server: server}
+		loads[server.Id] = load
+		candidates = append(candidates, load)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoSharedServer
+	}
+
+	rows, err := brokerDb.Model(Instance{}).
+		Select("shared_server_id, count(*), coalesce(sum(db_storage), 0)").
+		Where("shared_server_id <> 0").
+		Group("shared_server_id").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, databases, storage int64
+		if err := rows.Scan(&id, &databases, &storage); err != nil {
+			return nil, err
+		}
+		if load, ok := loads[id]; ok {
+			load.Databases = databases
+			load.Storage = storage
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var less func(a, b *sharedServerLoad) bool
+	switch strategy {
+	case PlacementLeastSize:
+		less = func(a, b *sharedServerLoad) bool { return a.Storage < b.Storage }
+	case PlacementLeastDatabases, "":
+		less = func(a, b *sharedServerLoad) bool { return a.Databases < b.Databases }
+	default:
+		return nil, errors.New("Unknown placement strategy: " + strategy)
+	}
+	sort.Stable(sharedServerLoads{loads: candidates, less: less})
+
+	return &candidates[0].Server, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlaceSharedInstance(t *testing.T) {
+	setup()
+	plan := &Plan{DbType: "postgres", DbStorage: 5}
+
+	server, err := PlaceSharedInstance(brokerDB, plan, PlacementLeastDatabases)
+	if server != nil || err != nil {
+		t.Error("Without servers, the instance should stay on the default server")
+	}
+
+	small := SharedServer{Name: "small", DbType: "postgres", Enabled: true, Tags: "ssd"}
+	big := SharedServer{Name: "big", DbType: "postgres", Enabled: true, Tags: "ssd, eu"}
+	disabled := SharedServer{Name: "disabled", DbType: "postgres", Tags: "ssd,eu"}
+	mysql := SharedServer{Name: "mysql", DbType: "mysql", Enabled: true, Tags: "ssd,eu"}
+	for _, server := range []*SharedServer{&small, &big, &disabled, &mysql} {
+		brokerDB.Create(server)
+	}
+
+	// small hosts 2 databases of 5GB, big 1 database of 50GB.
+	brokerDB.Create(&Instance{Uuid: "a", SharedServerId: small.Id, DbStorage: 5})
+	brokerDB.Create(&Instance{Uuid: "b", SharedServerId: small.Id, DbStorage: 5})
+	brokerDB.Create(&Instance{Uuid: "c", SharedServerId: big.Id, DbStorage: 50})
+
+	server, _ = PlaceSharedInstance(brokerDB, plan, PlacementLeastDatabases)
+	if server == nil || server.Id != big.Id {
+		t.Error("The server hosting the fewest databases should be picked")
+	}
+
+	server, _ = PlaceSharedInstance(brokerDB, plan, PlacementLeastSize)
+	if server == nil || server.Id != small.Id {
+		t.Error("The server with the least storage should be picked")
+	}
+
+	plan.ServerTags = []string{"eu"}
+	server, _ = PlaceSharedInstance(brokerDB, plan, PlacementLeastSize)
+	if server == nil || server.Id != big.Id {
+		t.Error("Only the servers with the tags of the plan should be picked")
+	}
+
+	plan.ServerTags = []string{"us"}
+	if _, err := PlaceSharedInstance(brokerDB, plan, PlacementLeastSize); err != ErrNoSharedServer {
+		t.Error("Without servers matching the plan, the placement should fail")
+	}
+
+	plan.ServerTags = nil
+	if _, err := PlaceSharedInstance(brokerDB, plan, "random"); err == nil {
+		t.Error("An unknown strategy should fail")
+	}
+}
+
+func TestSharedServerPassword(t *testing.T) {
+	key := "12345678901234567890123456789012"
+	server := SharedServer{DbType: "postgres", Url: "db.example.com", Port: 5432}
+	if err := server.SetPassword("secret", key); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.Password == "secret" {
+		t.Error("The password should be encrypted")
+	}
+
+	dbConfig, err := server.DBConfig(key)
+	if err != nil || dbConfig.Password != "secret" || dbConfig.Url != "db.example.com" {
+		t.Error("The configuration should have the decrypted password")
+	}
+}
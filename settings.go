@@ -8,41 +8,74 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 const (
-	AdapterShared string = "shared"
+	AdapterShared    string = "shared"
 	AdapterDedicated string = "dedicated"
+	AdapterAurora    string = "aurora"
 )
 
 type Settings struct {
 	EncryptionKey string
 	DbConfig      *DBConfig
-	InstanceTags  map[string]string
-	Environment   string
-	SecGroup      string
-	SubnetGroup   string
+	// SharedMySQLConfig is the MySQL server of the shared MySQL plans. Nil if there is none.
+	SharedMySQLConfig *DBConfig
+	// SharedPlacement is the strategy placing the shared instances on the shared servers.
+	SharedPlacement string
+	// QuotaCheckInterval is the time between two checks of the storage quotas of the shared instances.
+	QuotaCheckInterval time.Duration
+	InstanceTags       map[string]string
+	Environment        string
+	SecGroup           string
+	SubnetGroup        string
+	// AwsAccountId is the AWS account of the RDS instances, needed to tag their final snapshots.
+	AwsAccountId string
 }
 
 // Main function to create database instances
-func (s Settings) InitializeAdapter(plan *Plan,
-	sharedDbConn *gorm.DB) (DBAdapter, error) {
+func (s Settings) InitializeAdapter(plan *Plan, i *Instance,
+	brokerDb *gorm.DB) (DBAdapter, error) {
 
 	var dbAdapter DBAdapter
 	// For test environments, use a mock adapter.
 	if s.Environment == "test" {
-		dbAdapter = &MockDBAdapter{}
+		dbAdapter = &MockDBAdapter{ReadReplicas: plan.ReadReplicas}
 		return dbAdapter, nil
 	}
 
 	switch plan.Adapter {
 	case AdapterShared:
-		dbAdapter = &SharedDBAdapter{
-			SharedDbConn: sharedDbConn,
+		conn, dbConfig, err := s.sharedServerConn(plan, i, brokerDb)
+		if err != nil {
+			return nil, err
+		}
+		switch plan.DbType {
+		case "mysql":
+			dbAdapter = &SharedMySQLAdapter{
+				SharedDbConn: conn,
+				DbConfig:     dbConfig,
+			}
+		default:
+			dbAdapter = &SharedDBAdapter{
+				SharedDbConn: conn,
+				DbConfig:     dbConfig,
+				Plan:         plan,
+			}
 		}
 	case AdapterDedicated:
 		dbAdapter = &DedicatedDBAdapter{
 			InstanceType: plan.InstanceType,
+			AccountId:    s.AwsAccountId,
+			SecGroup:     s.SecGroup,
+			Plan:         plan,
+		}
+	case AdapterAurora:
+		dbAdapter = &AuroraDBAdapter{
+			InstanceType: plan.InstanceType,
+			AccountId:    s.AwsAccountId,
+			Plan:         plan,
 		}
 	default:
 		return nil, errors.New("Adapter not found")
@@ -51,6 +84,38 @@ func (s Settings) InitializeAdapter(plan *Plan,
 	return dbAdapter, nil
 }
 
+// sharedServerConn returns the connection to the server hosting the shared instance.
+// The instances without a shared server are hosted on the broker database for Postgres
+// and on the shared MySQL server for MySQL.
+func (s Settings) sharedServerConn(plan *Plan, i *Instance,
+	brokerDb *gorm.DB) (*gorm.DB, *DBConfig, error) {
+
+	if i.SharedServerId != 0 {
+		server := SharedServer{}
+		brokerDb.Where("id = ?", i.SharedServerId).First(&server)
+		if server.Id == 0 {
+			return nil, nil, errors.New("The shared server of the instance cannot be found")
+		}
+		dbConfig, err := server.DBConfig(s.EncryptionKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := SharedDBConn(dbConfig)
+		return conn, dbConfig, err
+	}
+
+	switch plan.DbType {
+	case "mysql":
+		if s.SharedMySQLConfig == nil {
+			return nil, nil, errors.New("There is no shared MySQL server")
+		}
+		conn, err := SharedDBConn(s.SharedMySQLConfig)
+		return conn, s.SharedMySQLConfig, err
+	default:
+		return brokerDb, s.DbConfig, nil
+	}
+}
+
 // Load settings from environment variables
 func (s *Settings) LoadFromEnv() error {
 	log.Println("Loading settings")
@@ -74,11 +139,52 @@ func (s *Settings) LoadFromEnv() error {
 			return errors.New("Couldn't load port number")
 		}
 	} else {
-		dbConfig.Port = 5432
+		dbConfig.Port = DefaultPort(dbConfig.DbType)
 	}
 
 	s.DbConfig = &dbConfig
 
+	// Load the placement strategy of the shared instances
+	s.SharedPlacement = os.Getenv("SHARED_PLACEMENT")
+	switch s.SharedPlacement {
+	case "":
+		s.SharedPlacement = PlacementLeastDatabases
+	case PlacementLeastDatabases, PlacementLeastSize:
+	default:
+		return errors.New("Unknown shared placement strategy: " + s.SharedPlacement)
+	}
+
+	// Load the interval of the storage quota checks
+	s.QuotaCheckInterval = DefaultQuotaCheckInterval
+	if interval := os.Getenv("QUOTA_CHECK_INTERVAL"); interval != "" {
+		var err error
+		s.QuotaCheckInterval, err = time.ParseDuration(interval)
+		if err != nil || s.QuotaCheckInterval <= 0 {
+			return errors.New("Couldn't load the quota check interval")
+		}
+	}
+
+	// Load the shared MySQL server settings
+	if os.Getenv("SHARED_MYSQL_URL") != "" {
+		mysqlConfig := DBConfig{DbType: "mysql"}
+		mysqlConfig.Url = os.Getenv("SHARED_MYSQL_URL")
+		mysqlConfig.Username = os.Getenv("SHARED_MYSQL_USER")
+		mysqlConfig.Password = os.Getenv("SHARED_MYSQL_PASS")
+		if mysqlConfig.Sslmode = os.Getenv("SHARED_MYSQL_SSLMODE"); mysqlConfig.Sslmode == "" {
+			mysqlConfig.Sslmode = "require"
+		}
+		if os.Getenv("SHARED_MYSQL_PORT") != "" {
+			var err error
+			mysqlConfig.Port, err = strconv.ParseInt(os.Getenv("SHARED_MYSQL_PORT"), 10, 64)
+			if err != nil {
+				return errors.New("Couldn't load shared MySQL port number")
+			}
+		} else {
+			mysqlConfig.Port = DefaultPort(mysqlConfig.DbType)
+		}
+		s.SharedMySQLConfig = &mysqlConfig
+	}
+
 	// Load Encryption Key
 	s.EncryptionKey = os.Getenv("ENC_KEY")
 	if s.EncryptionKey == "" {
@@ -94,6 +200,7 @@ func (s *Settings) LoadFromEnv() error {
 	// Load AWS settings
 	s.SecGroup = os.Getenv("AWS_SEC_GROUP")
 	s.SubnetGroup = os.Getenv("AWS_DB_SUBNET_GROUP")
+	s.AwsAccountId = os.Getenv("AWS_ACCOUNT_ID")
 
 	// Set env to production
 	s.Environment = "production"
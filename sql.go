@@ -0,0 +1,273 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SQLDialect quotes the identifiers and the literals of the statements sent to a database engine.
+// The statements which can't take parameters (CREATE DATABASE, CREATE USER, ...) are built with FormatSQL,
+// the others are run with parameters.
+type SQLDialect interface {
+	QuoteIdentifier(name string) string
+	QuoteLiteral(value string) string
+}
+
+type postgresDialect struct{}
+
+// QuoteIdentifier quotes a Postgres identifier, doubling its double quotes.
+// The name is cut at its first NUL, which Postgres can't store.
+func (postgresDialect) QuoteIdentifier(name string) string {
+	if end := strings.IndexRune(name, 0); end > -1 {
+		name = name[:end]
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// QuoteLiteral quotes a Postgres string literal, doubling its single quotes.
+// Literals with backslashes use the escape string syntax, E'a\\b', so that they are read
+// the same whatever standard_conforming_strings is.
+func (postgresDialect) QuoteLiteral(value string) string {
+	value = strings.Replace(value, `'`, `''`, -1)
+	if strings.Contains(value, `\`) {
+		return `E'` + strings.Replace(value, `\`, `\\`, -1) + `'`
+	}
+	return `'` + value + `'`
+}
+
+type mysqlDialect struct{}
+
+// QuoteIdentifier quotes a MySQL identifier, doubling its backticks.
+func (mysqlDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// mysqlLiteralEscaper escapes the characters mysql_real_escape_string escapes.
+var mysqlLiteralEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	`"`, `\"`,
+	"\x00", `\0`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\x1a", `\Z`,
+)
+
+// QuoteLiteral quotes a MySQL string literal, escaping its special characters with backslashes.
+// It expects the server not to run with the NO_BACKSLASH_ESCAPES SQL mode, the default.
+func (mysqlDialect) QuoteLiteral(value string) string {
+	return `'` + mysqlLiteralEscaper.Replace(value) + `'`
+}
+
+var (
+	PostgresDialect SQLDialect = postgresDialect{}
+	MySQLDialect    SQLDialect = mysqlDialect{}
+)
+
+// DialectOf returns the dialect of the database type.
+func DialectOf(dbType string) SQLDialect {
+	switch dbType {
+	case "mysql", "mariadb":
+		return MySQLDialect
+	default:
+		return PostgresDialect
+	}
+}
+
+// FormatSQL builds a statement like fmt.Sprintf, with the verbs:
+// * %I - A quoted identifier, from a string
+// * %L - A quoted literal, from a string
+// * %d - An integer
+// * %% - A percent sign
+// Any other verb, or an argument not matching its verb, is a programming error and panics.
+func FormatSQL(dialect SQLDialect, format string, args ...interface{}) string {
+	var b bytes.Buffer
+	next := 0
+	arg := func(verb byte) interface{} {
+		if next >= len(args) {
+			panic(fmt.Sprintf("FormatSQL: missing argument for %%%c in %q", verb, format))
+		}
+		next++
+		return args[next-1]
+	}
+
+	for k := 0; k < len(format); k++ {
+		if format[k] != '%' {
+			b.WriteByte(format[k])
+			continue
+		}
+		k++
+		if k == len(format) {
+			panic(fmt.Sprintf("FormatSQL: trailing %% in %q", format))
+		}
+		switch verb := format[k]; verb {
+		case '%':
+			b.WriteByte('%')
+		case 'I', 'L':
+			value, ok := arg(verb).(string)
+			if !ok {
+				panic(fmt.Sprintf("FormatSQL: %%%c takes a string in %q", verb, format))
+			}
+			if verb == 'I' {
+				b.WriteString(dialect.QuoteIdentifier(value))
+			} else {
+				b.WriteString(dialect.QuoteLiteral(value))
+			}
+		case 'd':
+			switch value := arg(verb).(type) {
+			case int:
+				b.WriteString(strconv.Itoa(value))
+			case int64:
+				b.WriteString(strconv.FormatInt(value, 10))
+			default:
+				panic(fmt.Sprintf("FormatSQL: %%d takes an integer in %q", format))
+			}
+		default:
+			panic(fmt.Sprintf("FormatSQL: unknown verb %%%c in %q", verb, format))
+		}
+	}
+
+	if next != len(args) {
+		panic(fmt.Sprintf("FormatSQL: too many arguments for %q", format))
+	}
+	return b.String()
+}
+
+// execSQL runs a statement built with FormatSQL on the connection.
+// It bypasses gorm, which rewrites the $$ of the statements it runs.
+func execSQL(conn *gorm.DB, statement string) error {
+	_, err := conn.DB().Exec(statement)
+	return err
+}
+
+// Statements of the shared Postgres servers.
+
+func postgresCreateDatabase(database string) string {
+	return FormatSQL(PostgresDialect, "CREATE DATABASE %I;", database)
+}
+
+// postgresCreateDatabaseFrom creates a database as a copy of the template database.
+func postgresCreateDatabaseFrom(database, template string) string {
+	return FormatSQL(PostgresDialect, "CREATE DATABASE %I TEMPLATE %I;", database, template)
+}
+
+// postgresCreateRole creates a role which can't log in, to own the objects of an instance.
+func postgresCreateRole(role string) string {
+	return FormatSQL(PostgresDialect, "CREATE ROLE %I NOLOGIN;", role)
+}
+
+// postgresGrantRole makes the member a member of the role.
+func postgresGrantRole(role, member string) string {
+	return FormatSQL(PostgresDialect, "GRANT %I TO %I;", role, member)
+}
+
+func postgresRevokeRole(role, member string) string {
+	return FormatSQL(PostgresDialect, "REVOKE %I FROM %I;", role, member)
+}
+
+// postgresRoleLogin lets the role log in or stops it from logging in.
+// Only the roles with CREATEROLE can change it, the role itself can't.
+func postgresRoleLogin(role string, login bool) string {
+	if login {
+		return FormatSQL(PostgresDialect, "ALTER ROLE %I LOGIN;", role)
+	}
+	return FormatSQL(PostgresDialect, "ALTER ROLE %I NOLOGIN;", role)
+}
+
+func postgresCreateUser(username, password string) string {
+	return FormatSQL(PostgresDialect, "CREATE USER %I WITH PASSWORD %L;", username, password)
+}
+
+// postgresCreateUserInRole creates a user member of the role.
+func postgresCreateUserInRole(username, password, role string) string {
+	return FormatSQL(PostgresDialect, "CREATE USER %I WITH PASSWORD %L IN ROLE %I;", username, password, role)
+}
+
+// postgresSetRole makes the user switch to the role on login.
+func postgresSetRole(username, role string) string {
+	return FormatSQL(PostgresDialect, "ALTER USER %I SET ROLE %I;", username, role)
+}
+
+// postgresGrantRoleToCurrentUser makes the current user a member of the role.
+// On RDS, the master user needs it to hand objects over to the role and drop them afterwards.
+func postgresGrantRoleToCurrentUser(role string) string {
+	return FormatSQL(PostgresDialect, "GRANT %I TO CURRENT_USER;", role)
+}
+
+func postgresDatabaseOwner(database, owner string) string {
+	return FormatSQL(PostgresDialect, "ALTER DATABASE %I OWNER TO %I;", database, owner)
+}
+
+// postgresRevokeDatabase revokes the CONNECT, CREATE and TEMPORARY privileges every role has on a new database.
+func postgresRevokeDatabase(database string) string {
+	return FormatSQL(PostgresDialect, "REVOKE ALL ON DATABASE %I FROM PUBLIC;", database)
+}
+
+func postgresSchemaOwner(schema, owner string) string {
+	return FormatSQL(PostgresDialect, "ALTER SCHEMA %I OWNER TO %I;", schema, owner)
+}
+
+// postgresRevokeSchema revokes the USAGE and CREATE privileges every role has on the public schema.
+func postgresRevokeSchema(schema string) string {
+	return FormatSQL(PostgresDialect, "REVOKE ALL ON SCHEMA %I FROM PUBLIC;", schema)
+}
+
+// postgresDatabaseConnectionLimit limits the connections to the database, -1 for no limit.
+func postgresDatabaseConnectionLimit(database string, limit int64) string {
+	return FormatSQL(PostgresDialect, "ALTER DATABASE %I CONNECTION LIMIT %d;", database, limit)
+}
+
+// postgresReassignOwned hands the objects of the current database owned by a role over to another role.
+// The databases owned by the role are handed over too.
+func postgresReassignOwned(from, to string) string {
+	return FormatSQL(PostgresDialect, "REASSIGN OWNED BY %I TO %I;", from, to)
+}
+
+// postgresDropOwned drops the objects of the current database owned by a role and revokes its privileges.
+func postgresDropOwned(role string) string {
+	return FormatSQL(PostgresDialect, "DROP OWNED BY %I;", role)
+}
+
+func postgresConnectionLimit(role string, limit int64) string {
+	return FormatSQL(PostgresDialect, "ALTER ROLE %I CONNECTION LIMIT %d;", role, limit)
+}
+
+// postgresRoleDefault sets the default value of a setting for the sessions of the role.
+func postgresRoleDefault(role, setting, value string) string {
+	return FormatSQL(PostgresDialect, "ALTER ROLE %I SET %I = %L;", role, setting, value)
+}
+
+func postgresDropDatabase(database string) string {
+	return FormatSQL(PostgresDialect, "DROP DATABASE IF EXISTS %I;", database)
+}
+
+func postgresDropUser(username string) string {
+	return FormatSQL(PostgresDialect, "DROP USER IF EXISTS %I;", username)
+}
+
+// Statements of the shared MySQL servers. The users can connect from any host.
+
+func mysqlCreateDatabase(database string) string {
+	return FormatSQL(MySQLDialect, "CREATE DATABASE %I;", database)
+}
+
+func mysqlCreateUser(username, password string) string {
+	return FormatSQL(MySQLDialect, "CREATE USER %L@'%%' IDENTIFIED BY %L;", username, password)
+}
+
+func mysqlGrantDatabase(database, username string) string {
+	return FormatSQL(MySQLDialect, "GRANT ALL PRIVILEGES ON %I.* TO %L@'%%';", database, username)
+}
+
+func mysqlDropDatabase(database string) string {
+	return FormatSQL(MySQLDialect, "DROP DATABASE IF EXISTS %I;", database)
+}
+
+// mysqlDropUser drops the user. DROP USER IF EXISTS needs MySQL 5.7, so it fails when the user is gone.
+func mysqlDropUser(username string) string {
+	return FormatSQL(MySQLDialect, "DROP USER %L@'%%';", username)
+}
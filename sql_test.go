@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPostgresDialect(t *testing.T) {
+	quotes := []struct{ value, identifier, literal string }{
+		{`db1`, `"db1"`, `'db1'`},
+		{`a"b`, `"a""b"`, `'a"b'`},
+		{`it's`, `"it's"`, `'it''s'`},
+		{`a\b'`, `"a\b'"`, `E'a\\b'''`},
+		{"a\x00b", `"a"`, "'a\x00b'"},
+	}
+	for _, q := range quotes {
+		if got := PostgresDialect.QuoteIdentifier(q.value); got != q.identifier {
+			t.Errorf("The identifier %q should be quoted as %s and it was %s", q.value, q.identifier, got)
+		}
+		if got := PostgresDialect.QuoteLiteral(q.value); got != q.literal {
+			t.Errorf("The literal %q should be quoted as %s and it was %s", q.value, q.literal, got)
+		}
+	}
+}
+
+func TestMySQLDialect(t *testing.T) {
+	quotes := []struct{ value, identifier, literal string }{
+		{"db1", "`db1`", `'db1'`},
+		{"a`b", "`a``b`", "'a`b'"},
+		{`it's`, "`it's`", `'it\'s'`},
+		{`a\b"`, "`a\\b\"`", `'a\\b\"'`},
+		{"a\x00\n\r\x1a", "`a\x00\n\r\x1a`", `'a\0\n\r\Z'`},
+	}
+	for _, q := range quotes {
+		if got := MySQLDialect.QuoteIdentifier(q.value); got != q.identifier {
+			t.Errorf("The identifier %q should be quoted as %s and it was %s", q.value, q.identifier, got)
+		}
+		if got := MySQLDialect.QuoteLiteral(q.value); got != q.literal {
+			t.Errorf("The literal %q should be quoted as %s and it was %s", q.value, q.literal, got)
+		}
+	}
+}
+
+func TestDialectOf(t *testing.T) {
+	if DialectOf("mysql") != MySQLDialect || DialectOf("mariadb") != MySQLDialect {
+		t.Error("MySQL and MariaDB should use the MySQL dialect")
+	}
+	if DialectOf("postgres") != PostgresDialect {
+		t.Error("Postgres should use the Postgres dialect")
+	}
+}
+
+func TestFormatSQL(t *testing.T) {
+	got := FormatSQL(MySQLDialect, "KILL %d; -- 100%% of %I, %L", int64(42), "db", "x")
+	if want := "KILL 42; -- 100% of `db`, 'x'"; got != want {
+		t.Errorf("The statement should be %s and it was %s", want, got)
+	}
+
+	invalid := []struct {
+		format string
+		args   []interface{}
+	}{
+		{"%I", nil},
+		{"%I", []interface{}{"a", "b"}},
+		{"%I", []interface{}{42}},
+		{"%d", []interface{}{"42"}},
+		{"%s", []interface{}{"a"}},
+		{"100%", nil},
+	}
+	for _, f := range invalid {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("The format %q with %v should panic", f.format, f.args)
+				}
+			}()
+			FormatSQL(PostgresDialect, f.format, f.args...)
+		}()
+	}
+}
+
+func TestSharedStatements(t *testing.T) {
+	statements := []struct{ got, want string }{
+		{postgresCreateDatabase("db1"), `CREATE DATABASE "db1";`},
+		{postgresCreateDatabaseFrom("db2", "db1"), `CREATE DATABASE "db2" TEMPLATE "db1";`},
+		{postgresCreateUser("u1", "p'1"), `CREATE USER "u1" WITH PASSWORD 'p''1';`},
+		{postgresCreateRole("u1"), `CREATE ROLE "u1" NOLOGIN;`},
+		{postgresGrantRole("u1", "u2"), `GRANT "u1" TO "u2";`},
+		{postgresRevokeRole("u1", "u2"), `REVOKE "u1" FROM "u2";`},
+		{postgresRoleLogin("u1", true), `ALTER ROLE "u1" LOGIN;`},
+		{postgresRoleLogin("u1", false), `ALTER ROLE "u1" NOLOGIN;`},
+		{postgresCreateUserInRole("u2", "p2", "u1"), `CREATE USER "u2" WITH PASSWORD 'p2' IN ROLE "u1";`},
+		{postgresSetRole("u2", "u1"), `ALTER USER "u2" SET ROLE "u1";`},
+		{postgresGrantRoleToCurrentUser("u1"), `GRANT "u1" TO CURRENT_USER;`},
+		{postgresDatabaseOwner("db1", "u1"), `ALTER DATABASE "db1" OWNER TO "u1";`},
+		{postgresRevokeDatabase("db1"), `REVOKE ALL ON DATABASE "db1" FROM PUBLIC;`},
+		{postgresSchemaOwner("public", "u1"), `ALTER SCHEMA "public" OWNER TO "u1";`},
+		{postgresRevokeSchema("public"), `REVOKE ALL ON SCHEMA "public" FROM PUBLIC;`},
+		{postgresDatabaseConnectionLimit("db1", -1), `ALTER DATABASE "db1" CONNECTION LIMIT -1;`},
+		{postgresReassignOwned("u1", "u2"), `REASSIGN OWNED BY "u1" TO "u2";`},
+		{postgresDropOwned("u1"), `DROP OWNED BY "u1";`},
+		{postgresConnectionLimit("u1", 10), `ALTER ROLE "u1" CONNECTION LIMIT 10;`},
+		{postgresRoleDefault("u1", "statement_timeout", "15min"), `ALTER ROLE "u1" SET "statement_timeout" = '15min';`},
+		{postgresDropDatabase(`db"; DROP TABLE instances; --`), `DROP DATABASE IF EXISTS "db""; DROP TABLE instances; --";`},
+		{postgresDropUser("u1"), `DROP USER IF EXISTS "u1";`},
+		{mysqlCreateDatabase("db1"), "CREATE DATABASE `db1`;"},
+		{mysqlCreateUser("u1", "p'1"), `CREATE USER 'u1'@'%' IDENTIFIED BY 'p\'1';`},
+		{mysqlGrantDatabase("db1", "u1"), "GRANT ALL PRIVILEGES ON `db1`.* TO 'u1'@'%';"},
+		{mysqlDropDatabase("db1"), "DROP DATABASE IF EXISTS `db1`;"},
+		{mysqlDropUser("u1"), `DROP USER 'u1'@'%';`},
+	}
+	for _, s := range statements {
+		if s.got != s.want {
+			t.Errorf("The statement should be %s and it was %s", s.want, s.got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BrokerAPIVersionHeader is the header the platforms use to tell which version of the
+// Open Service Broker API they speak.
+const BrokerAPIVersionHeader = "X-Broker-API-Version"
+
+// MinBrokerAPIVersion is the oldest version the broker supports.
+// Older versions do not support asynchronous operations, which the dedicated plans require.
+var MinBrokerAPIVersion = BrokerAPIVersion{Major: 2, Minor: 7}
+
+// BrokerAPIVersion is the version of the Open Service Broker API negotiated for a request.
+// Handlers can ask for it to gate the behaviour that depends on the version.
+type BrokerAPIVersion struct {
+	Major int
+	Minor int
+}
+
+// ParseBrokerAPIVersion parses a version such as "2.13".
+func ParseBrokerAPIVersion(value string) (BrokerAPIVersion, error) {
+	var version BrokerAPIVersion
+	parts := strings.Split(strings.TrimSpace(value), ".")
+	if len(parts) != 2 {
+		return version, fmt.Errorf("Invalid broker API version: (%s)", value)
+	}
+	var err error
+	if version.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return version, fmt.Errorf("Invalid broker API version: (%s)", value)
+	}
+	if version.Minor, err = strconv.Atoi(parts[1]); err != nil {
+		return version, fmt.Errorf("Invalid broker API version: (%s)", value)
+	}
+	return version, nil
+}
+
+// AtLeast tells if the version is the given version or a newer one.
+func (v BrokerAPIVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func (v BrokerAPIVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// BrokerAPIVersionHandler is a middleware that requires the broker API version header
+// and maps the negotiated BrokerAPIVersion for the handlers.
+// Newer minor versions are backwards compatible, so any 2.x from MinBrokerAPIVersion on is accepted.
+func BrokerAPIVersionHandler() martini.Handler {
+	return func(req *http.Request, c martini.Context, r render.Render) {
+		value := req.Header.Get(BrokerAPIVersionHeader)
+		if value == "" {
+			r.JSON(http.StatusPreconditionFailed, Response{"The " + BrokerAPIVersionHeader + " header is required"})
+			return
+		}
+		version, err := ParseBrokerAPIVersion(value)
+		if err != nil {
+			r.JSON(http.StatusPreconditionFailed, Response{err.Error()})
+			return
+		}
+		if version.Major != MinBrokerAPIVersion.Major || !version.AtLeast(MinBrokerAPIVersion.Major, MinBrokerAPIVersion.Minor) {
+			desc := fmt.Sprintf("Unsupported broker API version %s. Supported versions are %s and newer %d.x versions",
+				version, MinBrokerAPIVersion, MinBrokerAPIVersion.Major)
+			r.JSON(http.StatusPreconditionFailed, Response{desc})
+			return
+		}
+		c.Map(version)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseBrokerAPIVersion(t *testing.T) {
+	version, err := ParseBrokerAPIVersion("2.13")
+	if err != nil || version.Major != 2 || version.Minor != 13 {
+		t.Error("2.13 should be parsed and it returned", version, err)
+	}
+
+	for _, value := range []string{"", "2", "2.x", "v2.13", "2.13.1"} {
+		if _, err := ParseBrokerAPIVersion(value); err == nil {
+			t.Error(value, "should not be parsed")
+		}
+	}
+}
+
+func TestBrokerAPIVersionAtLeast(t *testing.T) {
+	version := BrokerAPIVersion{Major: 2, Minor: 13}
+
+	if !version.AtLeast(2, 7) || !version.AtLeast(2, 13) || !version.AtLeast(1, 20) {
+		t.Error(version, "should be at least 2.7, 2.13 and 1.20")
+	}
+
+	if version.AtLeast(2, 14) || version.AtLeast(3, 0) {
+		t.Error(version, "should not be at least 2.14 and 3.0")
+	}
+}